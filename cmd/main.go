@@ -2,12 +2,17 @@ package main
 
 import (
 	"context"
+	"fmt"
 
 	"github.com/DeneesK/file-downloader/internal/app"
 	"github.com/DeneesK/file-downloader/internal/app/conf"
 	"github.com/DeneesK/file-downloader/internal/app/logger"
 	"github.com/DeneesK/file-downloader/internal/app/services"
+	"github.com/DeneesK/file-downloader/internal/app/storage/boltstorage"
 	"github.com/DeneesK/file-downloader/internal/app/storage/memorystorage"
+	"github.com/DeneesK/file-downloader/pkg/downloader"
+	"github.com/DeneesK/file-downloader/pkg/httpclient"
+	"github.com/DeneesK/file-downloader/pkg/netguard"
 )
 
 func main() {
@@ -15,15 +20,137 @@ func main() {
 	log := logger.NewLogger(config.Env)
 	defer log.Sync()
 
-	storage := memorystorage.NewMemoryStorage()
+	storage, err := newStorage(config)
+	if err != nil {
+		log.Fatalf("failed to open %s storage: %s", config.StorageType, err)
+	}
 
 	ctx, close := context.WithCancel(context.Background())
 	defer close()
-	defer storage.Close(ctx) // в memory storage ctx не нужен, но на будущее если поменяем реализацию и заменим на ДБ
+	defer storage.Close(ctx)
 
-	zipService := services.NewZipService(config.ArchiveDir)
-	taskService := services.NewTaskService(storage, log, config.MaxActiveTasks, config.MaxLinksPerTask, zipService)
+	if err := storage.Ping(ctx); err != nil {
+		log.Fatalf("storage is not available: %s", err)
+	}
 
-	app := app.NewApp(config.ServerAddr, log, taskService)
+	archivers := services.NewArchiverRegistry(config.ArchiveDir)
+	compression := services.ArchiveOptions{Compression: config.Compression, Level: config.CompressionLevel}
+	if err := compression.Validate(); err != nil {
+		log.Fatalf("invalid compression settings: %s", err)
+	}
+	fileTypes, err := loadFileTypes(config)
+	if err != nil {
+		log.Fatalf("invalid file types: %s", err)
+	}
+	retryPolicy := services.RetryPolicy{
+		MaxAttempts:       config.RetryMaxAttempts,
+		BaseDelay:         config.RetryBaseDelay,
+		MaxDelay:          config.RetryMaxDelay,
+		Jitter:            config.RetryJitter,
+		RetryableStatuses: config.RetryableStatuses,
+	}
+	guard, err := netguard.New(netguard.Config{
+		Allow: config.OutboundAllow,
+		Deny:  config.OutboundDeny,
+		Logf:  log.Warnf,
+	})
+	if err != nil {
+		log.Fatalf("invalid outbound rules: %s", err)
+	}
+	client, err := httpclient.New(httpclient.Config{
+		ConnectTimeout:        config.HTTP.ConnectTimeout,
+		TLSHandshakeTimeout:   config.HTTP.TLSTimeout,
+		ResponseHeaderTimeout: config.HTTP.HeaderTimeout,
+		IdleReadTimeout:       config.HTTP.IdleReadTimeout,
+		Proxy:                 config.HTTP.Proxy,
+		CAFile:                config.HTTP.CAFile,
+		CertFile:              config.HTTP.ClientCert,
+		KeyFile:               config.HTTP.ClientKey,
+		UserAgent:             config.HTTP.UserAgent,
+		MaxIdleConns:          config.HTTP.MaxIdleConns,
+		MaxIdleConnsPerHost:   config.HTTP.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       config.HTTP.MaxConnsPerHost,
+		IdleConnTimeout:       config.HTTP.IdleConnTimeout,
+		Guard:                 guard,
+	})
+	if err != nil {
+		log.Fatalf("invalid http client settings: %s", err)
+	}
+	fileDownloader := downloader.New(downloader.Config{
+		Chunks:       config.DownloadChunks,
+		MinChunkSize: config.MinChunkSize,
+		Client:       client,
+	})
+	webhooks := services.DefaultWebhookConfig
+	webhooks.Secret = []byte(config.WebhookSecret)
+	webhooks.Timeout = config.WebhookTimeout
+	webhooks.Retry.MaxAttempts = config.WebhookAttempts
+	webhooks.Retry.BaseDelay = config.WebhookBaseDelay
+	webhooks.Retry.MaxDelay = config.WebhookMaxDelay
+	taskService := services.NewTaskService(
+		storage, log, config.MaxActiveTasks, config.MaxLinksPerTask, archivers,
+		services.WithRetryPolicy(retryPolicy),
+		services.WithDownloader(fileDownloader),
+		services.WithStreaming(config.StreamMode),
+		services.WithCompression(compression),
+		services.WithManifest(config.Manifest),
+		services.WithWorkers(config.Workers, config.LinkWorkers),
+		services.WithShutdownTimeout(config.ShutdownTimeout),
+		services.WithProgressInterval(config.ProgressInterval),
+		services.WithWebhooks(webhooks),
+		services.WithFileTypes(fileTypes),
+		services.WithNetGuard(guard),
+		services.WithHTTPClient(client),
+		services.WithSizeLimits(config.MaxFileBytes, config.MaxTaskBytes),
+		services.WithDiskGuard(config.ArchiveDir, config.MinFreeDiskBytes),
+		services.WithBaseURL(config.BaseURL),
+		services.WithLinkSigning([]byte(config.SignKey), config.LinkTTL),
+		services.WithPasswordKey([]byte(config.PasswordKey)),
+		services.WithDownloadDir(config.DownloadDir),
+	)
+	janitor := services.NewJanitor(taskService, log, services.JanitorConfig{
+		Interval:        config.JanitorInterval,
+		ArchiveTTL:      config.ArchiveTTL,
+		MaxArchiveBytes: config.MaxArchiveBytes,
+		DownloadDir:     config.DownloadDir,
+		ArchiveDir:      config.ArchiveDir,
+		OrphanAge:       config.OrphanAge,
+	})
+
+	if config.SignKey == "" {
+		log.Infoln("SIGN_KEY is not set, archive links will be invalid after restart")
+	}
+	if config.WebhookSecret == "" {
+		log.Infoln("WEBHOOK_SECRET is not set, tasks with a callback url are rejected")
+	}
+	if config.PasswordKey == "" {
+		log.Infoln("PASSWORD_KEY is not set, encrypted tasks unfinished at restart will fail")
+	}
+
+	if err := taskService.Recover(ctx); err != nil {
+		log.Fatalf("failed to recover unfinished tasks: %s", err)
+	}
+
+	app := app.NewApp(config.ServerAddr, log, taskService, janitor)
 	app.Run()
 }
+
+// loadFileTypes returns the types from the file of FILE_TYPES_FILE if it is
+// set, the built-in ones named in ALLOWED_TYPES otherwise.
+func loadFileTypes(config *conf.ServerConf) ([]services.FileType, error) {
+	if config.FileTypesPath != "" {
+		return services.LoadFileTypes(config.FileTypesPath)
+	}
+	return services.FileTypesByName(config.AllowedTypes)
+}
+
+func newStorage(config *conf.ServerConf) (services.TaskStorage, error) {
+	switch config.StorageType {
+	case conf.StorageBolt:
+		return boltstorage.NewBoltStorage(config.DBPath)
+	case conf.StorageMemory:
+		return memorystorage.NewMemoryStorage(), nil
+	default:
+		return nil, fmt.Errorf("unknown storage type %q", config.StorageType)
+	}
+}
@@ -1,19 +1,55 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
 	"context"
+	"crypto/aes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	cryptorand "crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"io"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/DeneesK/file-downloader/internal/app/model"
 	"github.com/DeneesK/file-downloader/internal/app/router"
 	"github.com/DeneesK/file-downloader/internal/app/services"
+	"github.com/DeneesK/file-downloader/internal/app/storage"
+	"github.com/DeneesK/file-downloader/internal/app/storage/boltstorage"
+	"github.com/DeneesK/file-downloader/internal/app/storage/memorystorage"
+	"github.com/DeneesK/file-downloader/pkg/downloader"
+	"github.com/DeneesK/file-downloader/pkg/httpclient"
+	"github.com/DeneesK/file-downloader/pkg/netguard"
 	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/klauspost/compress/zstd"
 	"github.com/stretchr/testify/assert"
 	"go.uber.org/zap"
 )
@@ -48,42 +84,90 @@ func (m *mockStorage) Update(_ context.Context, task model.Task) error {
 	return nil
 }
 
+func (m *mockStorage) List(_ context.Context) ([]model.Task, error) {
+	tasks := make([]model.Task, 0, len(m.tasks))
+	for _, task := range m.tasks {
+		tasks = append(tasks, *task)
+	}
+	return tasks, nil
+}
+
 func (m *mockStorage) Close(_ context.Context) error { return nil }
 func (m *mockStorage) Ping(_ context.Context) error  { return nil }
 
-type mockZip struct{}
+type mockArchiver struct{}
+
+func newMockArchivers() *services.Archivers {
+	archivers := services.NewArchivers()
+	archivers.Register(services.FormatZip, &mockArchiver{})
+	return archivers
+}
 
-func (z *mockZip) CreateZipArchive(files []string) (string, error) {
+func (z *mockArchiver) CreateArchive(files []services.ArchiveFile, opts services.ArchiveOptions) (string, error) {
 	return "/fake/path.zip", nil
 }
 
+func (z *mockArchiver) NewStream(opts services.ArchiveOptions) (services.ArchiveStream, error) {
+	return &mockArchiveStream{}, nil
+}
+
+type mockArchiveStream struct{}
+
+func (z *mockArchiveStream) Create(name string) (io.Writer, error) { return io.Discard, nil }
+func (z *mockArchiveStream) Discard()                              {}
+func (z *mockArchiveStream) Close() (string, error)                { return "/fake/path.zip", nil }
+func (z *mockArchiveStream) Abort()                                {}
+
 func TestServiceCreateTask(t *testing.T) {
 	store := newMockStorage()
 	logger, _ := zap.NewDevelopment()
 	log := logger.Sugar()
 	defer log.Sync()
-	service := services.NewTaskService(store, log, 3, 3, &mockZip{})
+	service := services.NewTaskService(store, log, 3, 3, newMockArchivers())
 
 	ctx := context.Background()
-	id, err := service.CreateTask(ctx)
+	created, err := service.CreateTask(ctx, model.TaskOptions{})
 
 	assert.NoError(t, err)
-	assert.NotEmpty(t, id)
+	assert.NotEmpty(t, created.ID)
 
-	task, err := store.Get(ctx, id)
+	task, err := store.Get(ctx, created.ID)
 	assert.NoError(t, err)
 	assert.Equal(t, model.StatusCreated, task.Status)
 }
 
+type failingStorage struct {
+	services.TaskStorage
+}
+
+func (failingStorage) Store(context.Context, *model.Task) error {
+	return errors.New("disk full")
+}
+
+func TestServiceCreateTask_StoreFails(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	log := logger.Sugar()
+	defer log.Sync()
+	service := services.NewTaskService(failingStorage{newMockStorage()}, log, 1, 3, newMockArchivers())
+
+	// A task that isn't stored doesn't hold a slot.
+	for range 2 {
+		_, err := service.CreateTask(context.Background(), model.TaskOptions{})
+		assert.EqualError(t, err, "disk full")
+	}
+	assert.Equal(t, 0, service.GetNumberActiveTasks())
+}
+
 func TestServiceAddLinks_Valid(t *testing.T) {
 	store := newMockStorage()
 	logger, _ := zap.NewDevelopment()
 	log := logger.Sugar()
 	defer log.Sync()
-	service := services.NewTaskService(store, log, 3, 3, &mockZip{})
+	service := services.NewTaskService(store, log, 3, 3, newMockArchivers())
 	ctx := context.Background()
 
-	id, _ := service.CreateTask(ctx)
+	created, _ := service.CreateTask(ctx, model.TaskOptions{})
+	id := created.ID
 	links := []string{
 		"https://example.com/a.pdf",
 		"https://example.com/b.jpeg",
@@ -101,14 +185,20 @@ func TestServiceAddLinks_InvalidExtension(t *testing.T) {
 	logger, _ := zap.NewDevelopment()
 	log := logger.Sugar()
 	defer log.Sync()
-	service := services.NewTaskService(store, log, 3, 3, &mockZip{})
+	service := services.NewTaskService(store, log, 3, 3, newMockArchivers())
 	ctx := context.Background()
 
-	id, _ := service.CreateTask(ctx)
+	created, _ := service.CreateTask(ctx, model.TaskOptions{})
+	id := created.ID
 	links := []string{"https://example.com/malware.exe"}
 
 	err := service.AddLinks(ctx, id, links)
-	assert.Equal(t, services.ErrNotValidExaction, err)
+	assert.ErrorIs(t, err, services.ErrNotValidExaction)
+	var rejected *services.RejectedLinksError
+	assert.ErrorAs(t, err, &rejected)
+	assert.Equal(t, map[string]string{
+		"https://example.com/malware.exe": "extension .exe is not allowed, allowed are .pdf, .jpg, .jpeg or none",
+	}, rejected.Links)
 }
 
 func TestHandlerCreateTask_Success(t *testing.T) {
@@ -116,7 +206,7 @@ func TestHandlerCreateTask_Success(t *testing.T) {
 	logger, _ := zap.NewDevelopment()
 	log := logger.Sugar()
 	defer log.Sync()
-	service := services.NewTaskService(store, log, 3, 3, &mockZip{})
+	service := services.NewTaskService(store, log, 3, 3, newMockArchivers())
 	req := httptest.NewRequest(http.MethodPost, "/task", nil)
 	w := httptest.NewRecorder()
 	handler := router.CreateTask(service, log)
@@ -137,7 +227,7 @@ func TestHandlerCreateTask_TooMany(t *testing.T) {
 	logger, _ := zap.NewDevelopment()
 	log := logger.Sugar()
 	defer log.Sync()
-	service := services.NewTaskService(store, log, 0, 3, &mockZip{})
+	service := services.NewTaskService(store, log, 0, 3, newMockArchivers())
 	req := httptest.NewRequest(http.MethodPost, "/task", nil)
 	w := httptest.NewRecorder()
 
@@ -152,7 +242,7 @@ func TestHandlerAddLinks_Success(t *testing.T) {
 	logger, _ := zap.NewDevelopment()
 	log := logger.Sugar()
 	defer log.Sync()
-	service := services.NewTaskService(store, log, 3, 3, &mockZip{})
+	service := services.NewTaskService(store, log, 3, 3, newMockArchivers())
 	req := httptest.NewRequest(http.MethodPost, "/task", nil)
 	w := httptest.NewRecorder()
 
@@ -189,7 +279,7 @@ func TestHandlerAddLinks_InvalidType(t *testing.T) {
 	logger, _ := zap.NewDevelopment()
 	log := logger.Sugar()
 	defer log.Sync()
-	service := services.NewTaskService(store, log, 3, 3, &mockZip{})
+	service := services.NewTaskService(store, log, 3, 3, newMockArchivers())
 	req := httptest.NewRequest(http.MethodPost, "/task", nil)
 	w := httptest.NewRecorder()
 
@@ -227,7 +317,7 @@ func TestGetTask_Success(t *testing.T) {
 	logger, _ := zap.NewDevelopment()
 	log := logger.Sugar()
 	defer log.Sync()
-	service := services.NewTaskService(store, log, 3, 3, &mockZip{})
+	service := services.NewTaskService(store, log, 3, 3, newMockArchivers())
 	req := httptest.NewRequest(http.MethodPost, "/task", nil)
 	w := httptest.NewRecorder()
 
@@ -261,3 +351,1952 @@ func TestGetTask_Success(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, taskReturned.ID, task.ID)
 }
+
+func TestDownloaderResume(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "file.pdf", time.Unix(0, 0), bytes.NewReader(data))
+	}))
+	defer srv.Close()
+
+	path := filepath.Join(t.TempDir(), "file.pdf")
+	err := os.WriteFile(path, data[:3000], 0644)
+	assert.NoError(t, err)
+
+	st := &downloader.State{Path: path, Offset: 3000, ETag: `"v1"`}
+	err = downloader.Resume(context.Background(), srv.URL+"/file.pdf", st)
+	assert.NoError(t, err)
+	assert.True(t, st.Done)
+
+	got, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, data, got)
+
+	st = &downloader.State{Path: path, Offset: 3000, ETag: `"v0"`}
+	err = downloader.Resume(context.Background(), srv.URL+"/file.pdf", st)
+	assert.NoError(t, err)
+	assert.Equal(t, `"v1"`, st.ETag)
+
+	got, err = os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, data, got)
+}
+
+func TestServiceRetry(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls < 3 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("%PDF-1.4"))
+	}))
+	defer srv.Close()
+
+	store := memorystorage.NewMemoryStorage()
+	logger, _ := zap.NewDevelopment()
+	log := logger.Sugar()
+	defer log.Sync()
+	policy := services.RetryPolicy{
+		MaxAttempts:       3,
+		BaseDelay:         time.Millisecond,
+		MaxDelay:          time.Millisecond,
+		RetryableStatuses: []int{http.StatusServiceUnavailable},
+	}
+	service := services.NewTaskService(store, log, 3, 1, newMockArchivers(), services.WithRetryPolicy(policy))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	created, err := service.CreateTask(ctx, model.TaskOptions{})
+	id := created.ID
+	assert.NoError(t, err)
+	err = service.AddLinks(ctx, id, []string{srv.URL + "/file.pdf"})
+	assert.NoError(t, err)
+
+	err = service.SubmitTask(ctx, id)
+	assert.NoError(t, err)
+
+	go service.Start(ctx)
+
+	assert.Eventually(t, func() bool {
+		task, _ := service.GetTask(ctx, id)
+		return task.Status == model.StatusDone
+	}, 5*time.Second, 10*time.Millisecond)
+
+	task, _ := service.GetTask(ctx, id)
+	attempts := task.Attempts[srv.URL+"/file.pdf"]
+	assert.Equal(t, 3, len(attempts))
+	assert.Equal(t, http.StatusServiceUnavailable, attempts[0].StatusCode)
+	assert.Empty(t, attempts[2].Error)
+}
+
+func TestDownloaderChunked(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	var ranges atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			ranges.Add(1)
+		}
+		http.ServeContent(w, r, "file.pdf", time.Unix(0, 0), bytes.NewReader(data))
+	}))
+	defer srv.Close()
+
+	d := downloader.New(downloader.Config{Chunks: 4, MinChunkSize: 1000})
+	st := &downloader.State{Path: filepath.Join(t.TempDir(), "file.pdf")}
+	err := d.Resume(context.Background(), srv.URL+"/file.pdf", st)
+	assert.NoError(t, err)
+	assert.True(t, st.Done)
+	assert.Equal(t, int32(4), ranges.Load())
+
+	got, err := os.ReadFile(st.Path)
+	assert.NoError(t, err)
+	assert.Equal(t, data, got)
+}
+
+func TestDownloaderChunked_NoRanges(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	}))
+	defer srv.Close()
+
+	d := downloader.New(downloader.Config{Chunks: 4, MinChunkSize: 1000})
+	st := &downloader.State{Path: filepath.Join(t.TempDir(), "file.pdf")}
+	err := d.Resume(context.Background(), srv.URL+"/file.pdf", st)
+	assert.NoError(t, err)
+
+	got, err := os.ReadFile(st.Path)
+	assert.NoError(t, err)
+	assert.Equal(t, data, got)
+}
+
+func TestServiceStreaming_DropsBrokenEntry(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/broken.pdf" {
+			w.Header().Set("Content-Length", "100")
+			w.Write([]byte("%PDF-"))
+			return
+		}
+		w.Write([]byte("%PDF-1.4"))
+	}))
+	defer srv.Close()
+
+	store := memorystorage.NewMemoryStorage()
+	logger, _ := zap.NewDevelopment()
+	log := logger.Sugar()
+	defer log.Sync()
+	policy := services.RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	service := services.NewTaskService(store, log, 3, 2, services.NewArchiverRegistry(t.TempDir()),
+		services.WithRetryPolicy(policy), services.WithStreaming(true))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	created, err := service.CreateTask(ctx, model.TaskOptions{})
+	id := created.ID
+	assert.NoError(t, err)
+	err = service.AddLinks(ctx, id, []string{srv.URL + "/good.pdf", srv.URL + "/broken.pdf"})
+	assert.NoError(t, err)
+
+	err = service.SubmitTask(ctx, id)
+	assert.NoError(t, err)
+
+	go service.Start(ctx)
+
+	assert.Eventually(t, func() bool {
+		task, _ := service.GetTask(ctx, id)
+		return task.Status == model.StatusDone
+	}, 5*time.Second, 10*time.Millisecond)
+
+	task, _ := service.GetTask(ctx, id)
+	assert.Contains(t, task.FailedLinks, srv.URL+"/broken.pdf")
+
+	r, err := zip.OpenReader(task.Archive)
+	assert.NoError(t, err)
+	defer r.Close()
+	assert.Equal(t, 1, len(r.File))
+}
+
+// refusingStream fails to create the entries named in refuse and records
+// the ones it discards.
+type refusingStream struct {
+	mockArchiveStream
+	refuse    string
+	mu        sync.Mutex
+	created   []string
+	discarded []string
+}
+
+func (s *refusingStream) Create(name string) (io.Writer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if name == s.refuse {
+		return nil, errors.New("entry can't be created")
+	}
+	s.created = append(s.created, name)
+	return io.Discard, nil
+}
+
+func (s *refusingStream) Discard() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.discarded = append(s.discarded, s.created[len(s.created)-1])
+}
+
+type refusingArchiver struct {
+	mockArchiver
+	stream *refusingStream
+}
+
+func (a *refusingArchiver) NewStream(opts services.ArchiveOptions) (services.ArchiveStream, error) {
+	return a.stream, nil
+}
+
+func TestServiceStreaming_CreateFails(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("%PDF-1.4"))
+	}))
+	defer srv.Close()
+
+	stream := &refusingStream{refuse: "second.pdf"}
+	archivers := services.NewArchivers()
+	archivers.Register(services.FormatZip, &refusingArchiver{stream: stream})
+	store := memorystorage.NewMemoryStorage()
+	logger, _ := zap.NewDevelopment()
+	log := logger.Sugar()
+	defer log.Sync()
+	service := services.NewTaskService(store, log, 3, 2, archivers, services.WithStreaming(true),
+		services.WithRetryPolicy(services.RetryPolicy{MaxAttempts: 1}))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	created, err := service.CreateTask(ctx, model.TaskOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, service.AddLinks(ctx, created.ID, []string{srv.URL + "/first.pdf", srv.URL + "/second.pdf"}))
+	assert.NoError(t, service.SubmitTask(ctx, created.ID))
+	go service.Start(ctx)
+
+	assert.Eventually(t, func() bool {
+		task, _ := service.GetTask(ctx, created.ID)
+		return task.Status == model.StatusDone
+	}, 5*time.Second, 10*time.Millisecond)
+
+	task, _ := service.GetTask(ctx, created.ID)
+	assert.Contains(t, task.FailedLinks, srv.URL+"/second.pdf")
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+	assert.Equal(t, []string{"first.pdf"}, stream.created)
+	assert.Empty(t, stream.discarded, "the entry before the failed one is kept")
+}
+
+// slowArchiver signals when it starts an archive and takes its time to
+// finish it.
+type slowArchiver struct {
+	mockArchiver
+	path    string
+	started chan struct{}
+}
+
+func (a *slowArchiver) CreateArchive(files []services.ArchiveFile, opts services.ArchiveOptions) (string, error) {
+	close(a.started)
+	time.Sleep(200 * time.Millisecond)
+	return a.path, os.WriteFile(a.path, []byte("archive"), 0644)
+}
+
+func TestServiceShutdown_KeepsArchive(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("%PDF-1.4"))
+	}))
+	defer srv.Close()
+
+	archiver := &slowArchiver{path: filepath.Join(t.TempDir(), "archive.zip"), started: make(chan struct{})}
+	archivers := services.NewArchivers()
+	archivers.Register(services.FormatZip, archiver)
+	store := memorystorage.NewMemoryStorage()
+	logger, _ := zap.NewDevelopment()
+	log := logger.Sugar()
+	defer log.Sync()
+	service := services.NewTaskService(store, log, 3, 1, archivers,
+		services.WithShutdownTimeout(10*time.Millisecond), services.WithDownloadDir(t.TempDir()))
+	ctx, cancel := context.WithCancel(context.Background())
+
+	created, err := service.CreateTask(ctx, model.TaskOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, service.AddLinks(ctx, created.ID, []string{srv.URL + "/file.pdf"}))
+	assert.NoError(t, service.SubmitTask(ctx, created.ID))
+	stopped := make(chan struct{})
+	go func() {
+		service.Start(ctx)
+		close(stopped)
+	}()
+
+	<-archiver.started
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("service did not stop")
+	}
+
+	// The deadline passed while the archive was being written, but the task
+	// is finished, as its downloads are already packed.
+	task, err := store.Get(context.Background(), created.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, model.StatusDone, task.Status)
+	assert.Equal(t, archiver.path, task.Archive)
+	assert.FileExists(t, archiver.path)
+}
+
+func TestServiceWorkerPool(t *testing.T) {
+	var arrived atomic.Int32
+	bothArrived := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if arrived.Add(1) == 2 {
+			close(bothArrived)
+		}
+		select {
+		case <-bothArrived:
+			w.Write([]byte("%PDF-1.4"))
+		case <-time.After(3 * time.Second):
+			w.WriteHeader(http.StatusGatewayTimeout)
+		}
+	}))
+	defer srv.Close()
+
+	store := memorystorage.NewMemoryStorage()
+	logger, _ := zap.NewDevelopment()
+	log := logger.Sugar()
+	defer log.Sync()
+	service := services.NewTaskService(store, log, 2, 1, newMockArchivers(), services.WithWorkers(2, 1))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var ids []string
+	for _, name := range []string{"a.pdf", "b.pdf"} {
+		created, err := service.CreateTask(ctx, model.TaskOptions{})
+		id := created.ID
+		assert.NoError(t, err)
+		err = service.AddLinks(ctx, id, []string{srv.URL + "/" + name})
+		assert.NoError(t, err)
+		err = service.SubmitTask(ctx, id)
+		assert.NoError(t, err)
+		ids = append(ids, id)
+	}
+
+	go service.Start(ctx)
+
+	for _, id := range ids {
+		assert.Eventually(t, func() bool {
+			task, _ := service.GetTask(ctx, id)
+			return task.Status == model.StatusDone
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+}
+
+func TestHandlerSubmitTask(t *testing.T) {
+	store := newMockStorage()
+	logger, _ := zap.NewDevelopment()
+	log := logger.Sugar()
+	defer log.Sync()
+	service := services.NewTaskService(store, log, 3, 3, newMockArchivers())
+	ctx := context.Background()
+
+	created, err := service.CreateTask(ctx, model.TaskOptions{})
+	id := created.ID
+	assert.NoError(t, err)
+
+	submit := func() int {
+		r := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/task/%s/submit", id), nil)
+		req := r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, &chi.Context{
+			URLParams: chi.RouteParams{
+				Keys:   []string{"id"},
+				Values: []string{id},
+			},
+		}))
+		w := httptest.NewRecorder()
+		router.SubmitTask(service, log).ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusBadRequest, submit())
+
+	err = service.AddLinks(ctx, id, []string{"https://example.com/a.pdf"})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusAccepted, submit())
+
+	task, _ := store.Get(ctx, id)
+	assert.Equal(t, model.StatusQueued, task.Status)
+
+	err = service.AddLinks(ctx, id, []string{"https://example.com/b.pdf"})
+	assert.Equal(t, services.ErrTaskFrozen, err)
+	assert.Equal(t, http.StatusConflict, submit())
+}
+
+func TestServiceCancelTask(t *testing.T) {
+	requested := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		w.Write([]byte("%PDF-"))
+		w.(http.Flusher).Flush()
+		close(requested)
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	store := memorystorage.NewMemoryStorage()
+	logger, _ := zap.NewDevelopment()
+	log := logger.Sugar()
+	defer log.Sync()
+	service := services.NewTaskService(store, log, 2, 1, newMockArchivers())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	idle, err := service.CreateTask(ctx, model.TaskOptions{})
+	assert.NoError(t, err)
+	err = service.CancelTask(ctx, idle.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, service.GetNumberActiveTasks())
+
+	created, err := service.CreateTask(ctx, model.TaskOptions{})
+	id := created.ID
+	assert.NoError(t, err)
+	err = service.AddLinks(ctx, id, []string{srv.URL + "/file.pdf"})
+	assert.NoError(t, err)
+	err = service.SubmitTask(ctx, id)
+	assert.NoError(t, err)
+
+	go service.Start(ctx)
+	<-requested
+
+	err = service.CancelTask(ctx, id)
+	assert.NoError(t, err)
+
+	task, _ := service.GetTask(ctx, id)
+	assert.Equal(t, model.StatusCanceled, task.Status)
+	assert.Empty(t, task.FailedLinks)
+	assert.Equal(t, 0, service.GetNumberActiveTasks())
+	for _, d := range task.Downloads {
+		assert.NoFileExists(t, d.Path)
+	}
+
+	err = service.CancelTask(ctx, id)
+	assert.ErrorIs(t, err, model.ErrInvalidTransition)
+}
+
+func TestBoltStorage(t *testing.T) {
+	ctx := context.Background()
+	store, err := boltstorage.NewBoltStorage(filepath.Join(t.TempDir(), "tasks.db"))
+	assert.NoError(t, err)
+	defer store.Close(ctx)
+	assert.NoError(t, store.Ping(ctx))
+
+	task := &model.Task{
+		ID:          "task",
+		Status:      model.StatusCollecting,
+		Links:       []string{"https://example.com/a.pdf"},
+		FailedLinks: map[string]string{},
+		Downloads:   map[string]*model.Download{"https://example.com/a.pdf": {Path: "/tmp/a.pdf", Offset: 10}},
+	}
+	assert.NoError(t, store.Store(ctx, task))
+	assert.Equal(t, storage.ErrNotUniqueVallation, store.Store(ctx, task))
+
+	got, err := store.Get(ctx, "task")
+	assert.NoError(t, err)
+	assert.Equal(t, task.Links, got.Links)
+	assert.Equal(t, int64(10), got.Downloads["https://example.com/a.pdf"].Offset)
+
+	got.Status = model.StatusQueued
+	assert.NoError(t, store.Update(ctx, got))
+	got, err = store.Get(ctx, "task")
+	assert.NoError(t, err)
+	assert.Equal(t, model.StatusQueued, got.Status)
+
+	_, err = store.Get(ctx, "missing")
+	assert.Equal(t, storage.ErrNotFound, err)
+}
+
+func TestServiceRecover(t *testing.T) {
+	data := append([]byte("%PDF-"), bytes.Repeat([]byte("0123456789"), 1000)...)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "file.pdf", time.Unix(0, 0), bytes.NewReader(data))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	donePath := filepath.Join(dir, "done.pdf")
+	partialPath := filepath.Join(dir, "partial.pdf")
+	assert.NoError(t, os.WriteFile(donePath, data, 0644))
+	assert.NoError(t, os.WriteFile(partialPath, append(data[:3000:3000], "garbage"...), 0644))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	store := memorystorage.NewMemoryStorage()
+	doneLink, partialLink := srv.URL+"/done.pdf", srv.URL+"/partial.pdf"
+	err := store.Store(ctx, &model.Task{
+		ID:          "running",
+		Status:      model.StatusRunning,
+		Links:       []string{doneLink, partialLink},
+		FailedLinks: map[string]string{},
+		Attempts:    map[string][]model.Attempt{},
+		Downloads: map[string]*model.Download{
+			doneLink:    {Path: donePath, Offset: int64(len(data)), Size: int64(len(data)), Done: true},
+			partialLink: {Path: partialPath, Offset: 3000, ETag: `"v1"`},
+		},
+	})
+	assert.NoError(t, err)
+	err = store.Store(ctx, &model.Task{ID: "done", Status: model.StatusDone})
+	assert.NoError(t, err)
+
+	logger, _ := zap.NewDevelopment()
+	log := logger.Sugar()
+	defer log.Sync()
+	service := services.NewTaskService(store, log, 3, 2, services.NewArchiverRegistry(t.TempDir()))
+
+	err = service.Recover(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, service.GetNumberActiveTasks())
+
+	task, _ := service.GetTask(ctx, "running")
+	assert.Equal(t, model.StatusQueued, task.Status)
+	assert.Equal(t, []string{donePath}, task.DownloadedFiles)
+	fi, err := os.Stat(partialPath)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3000), fi.Size())
+
+	go service.Start(ctx)
+
+	assert.Eventually(t, func() bool {
+		task, _ := service.GetTask(ctx, "running")
+		return task.Status == model.StatusDone
+	}, 5*time.Second, 10*time.Millisecond)
+
+	task, _ = service.GetTask(ctx, "running")
+	r, err := zip.OpenReader(task.Archive)
+	assert.NoError(t, err)
+	defer r.Close()
+	assert.Equal(t, 2, len(r.File))
+	for _, f := range r.File {
+		rc, err := f.Open()
+		assert.NoError(t, err)
+		got, _ := io.ReadAll(rc)
+		rc.Close()
+		assert.Equal(t, data, got)
+	}
+}
+
+func TestHandlerGetArchive(t *testing.T) {
+	archivePath := filepath.Join(t.TempDir(), "archive.zip")
+	assert.NoError(t, os.WriteFile(archivePath, []byte("PK archive content"), 0644))
+
+	store := newMockStorage()
+	store.Store(context.Background(), &model.Task{ID: "done", Status: model.StatusDone, Archive: archivePath})
+	store.Store(context.Background(), &model.Task{ID: "running", Status: model.StatusRunning})
+	logger, _ := zap.NewDevelopment()
+	log := logger.Sugar()
+	defer log.Sync()
+	service := services.NewTaskService(store, log, 3, 3, newMockArchivers(),
+		services.WithBaseURL("https://files.example.com/"),
+		services.WithLinkSigning([]byte("secret"), time.Hour))
+	r := router.NewRouter(service, log)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/task/done", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var task model.Task
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&task))
+	archiveURL, found := strings.CutPrefix(task.ArchiveURL, "https://files.example.com")
+	assert.True(t, found)
+	assert.True(t, strings.HasPrefix(archiveURL, "/task/done/archive?"))
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, archiveURL, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/zip", w.Header().Get("Content-Type"))
+	assert.Equal(t, `attachment; filename=done.zip`, w.Header().Get("Content-Disposition"))
+	assert.Equal(t, "PK archive content", w.Body.String())
+	etag := w.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+
+	req := httptest.NewRequest(http.MethodGet, archiveURL, nil)
+	req.Header.Set("Range", "bytes=3-9")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, "archive", w.Body.String())
+
+	req = httptest.NewRequest(http.MethodGet, archiveURL, nil)
+	req.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotModified, w.Code)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, strings.Replace(archiveURL, "/done/", "/running/", 1), nil))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/task/done/link", nil))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var link model.ArchiveLink
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&link))
+	assert.True(t, link.ExpiresAt.After(time.Now()))
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/task/running/link", nil))
+	assert.Equal(t, http.StatusConflict, w.Code)
+}
+
+func TestHandlerGetArchive_Expired(t *testing.T) {
+	store := newMockStorage()
+	store.Store(context.Background(), &model.Task{ID: "done", Status: model.StatusDone, Archive: "/fake/path.zip"})
+	logger, _ := zap.NewDevelopment()
+	log := logger.Sugar()
+	defer log.Sync()
+	service := services.NewTaskService(store, log, 3, 3, newMockArchivers(),
+		services.WithLinkSigning([]byte("secret"), -time.Minute))
+	r := router.NewRouter(service, log)
+
+	link, err := service.ArchiveLink(context.Background(), "done")
+	assert.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, link.URL, nil))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), services.ErrLinkExpired.Error())
+}
+
+func TestJanitor(t *testing.T) {
+	archiveDir, downloadDir := t.TempDir(), t.TempDir()
+	old := time.Now().Add(-2 * time.Hour)
+	writeFile := func(path string, size int, modTime time.Time) {
+		assert.NoError(t, os.WriteFile(path, bytes.Repeat([]byte("x"), size), 0644))
+		assert.NoError(t, os.Chtimes(path, modTime, modTime))
+	}
+	// Files are named the way the service names them, the janitor leaves
+	// anything else alone.
+	named := func(dir, ext string) string {
+		return filepath.Join(dir, uuid.NewString()+ext)
+	}
+	stalePath := named(archiveDir, ".zip")
+	coldPath := named(archiveDir, ".zip")
+	hotPath := named(archiveDir, ".zip")
+	writeFile(stalePath, 10, old)
+	writeFile(coldPath, 60, time.Now().Add(-time.Minute))
+	writeFile(hotPath, 60, time.Now().Add(-2*time.Minute))
+
+	partialPath := named(downloadDir, ".pdf")
+	orphanPath := named(downloadDir, ".pdf")
+	freshPath := named(downloadDir, ".pdf")
+	writeFile(partialPath, 10, old)
+	writeFile(orphanPath, 10, old)
+	writeFile(freshPath, 10, time.Now())
+	foreignArchive := filepath.Join(archiveDir, "dir_for_archives")
+	foreignDownload := filepath.Join(downloadDir, "notes.txt")
+	writeFile(foreignArchive, 0, old)
+	writeFile(foreignDownload, 10, old)
+
+	// Leftovers of a crash: a half-written archive, a tar spool file and the
+	// manifest directory of a task that was recovered since.
+	crashedPath := named(archiveDir, ".tar.gz")
+	compactedPath := named(archiveDir, ".zip.tmp")
+	spoolPath := filepath.Join(archiveDir, ".entry-123")
+	writeFile(crashedPath, 10, old)
+	writeFile(compactedPath, 10, old)
+	writeFile(spoolPath, 10, old)
+	const doneID, queuedID = "5f0c4d4e-8a5e-4b8e-9b7a-1d2a6f0e3c11", "7b3e2a10-4c6d-4f2e-8e1a-9c5b7d3f2a64"
+	staleDir, queuedDir, otherDir := filepath.Join(downloadDir, doneID), filepath.Join(downloadDir, queuedID), filepath.Join(downloadDir, "other")
+	for _, dir := range []string{staleDir, queuedDir, otherDir} {
+		assert.NoError(t, os.Mkdir(dir, 0755))
+		assert.NoError(t, os.Chtimes(dir, old, old))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	store := memorystorage.NewMemoryStorage()
+	store.Store(ctx, &model.Task{ID: "stale", Status: model.StatusDone, Archive: stalePath})
+	store.Store(ctx, &model.Task{ID: "cold", Status: model.StatusDone, Archive: coldPath})
+	store.Store(ctx, &model.Task{ID: "hot", Status: model.StatusDone, Archive: hotPath, LastAccessAt: time.Now()})
+	store.Store(ctx, &model.Task{ID: queuedID, Status: model.StatusQueued,
+		Downloads: map[string]*model.Download{"https://example.com/partial.pdf": {Path: partialPath}}})
+
+	logger, _ := zap.NewDevelopment()
+	log := logger.Sugar()
+	defer log.Sync()
+	service := services.NewTaskService(store, log, 3, 3, services.NewArchiverRegistry(archiveDir))
+	janitor := services.NewJanitor(service, log, services.JanitorConfig{
+		Interval:        time.Hour,
+		ArchiveTTL:      time.Hour,
+		MaxArchiveBytes: 100,
+		DownloadDir:     downloadDir,
+		ArchiveDir:      archiveDir,
+		OrphanAge:       time.Hour,
+	})
+	cancel()
+	janitor.Start(ctx)
+
+	for id, status := range map[string]string{
+		"stale": model.StatusExpired,
+		"cold":  model.StatusExpired,
+		"hot":   model.StatusDone,
+	} {
+		task, err := store.Get(context.Background(), id)
+		assert.NoError(t, err)
+		assert.Equal(t, status, task.Status, id)
+	}
+	task, _ := store.Get(context.Background(), "stale")
+	assert.NotEmpty(t, task.ExpiredReason)
+
+	for path, exists := range map[string]bool{
+		stalePath:       false,
+		coldPath:        false,
+		hotPath:         true,
+		partialPath:     true,
+		orphanPath:      false,
+		freshPath:       true,
+		crashedPath:     false,
+		compactedPath:   false,
+		spoolPath:       false,
+		staleDir:        false,
+		queuedDir:       true,
+		otherDir:        true,
+		foreignArchive:  true,
+		foreignDownload: true,
+	} {
+		_, err := os.Stat(path)
+		assert.Equal(t, exists, err == nil, path)
+	}
+}
+
+func readTarball(t *testing.T, path string, format services.Format) map[string]string {
+	f, err := os.Open(path)
+	assert.NoError(t, err)
+	defer f.Close()
+
+	var r io.Reader = f
+	switch format {
+	case services.FormatTarGz:
+		gz, err := gzip.NewReader(f)
+		assert.NoError(t, err)
+		r = gz
+	case services.FormatTarZst:
+		zr, err := zstd.NewReader(f)
+		assert.NoError(t, err)
+		defer zr.Close()
+		r = zr
+	}
+
+	entries := make(map[string]string)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		data, _ := io.ReadAll(tr)
+		entries[hdr.Name] = string(data)
+	}
+	return entries
+}
+
+func TestArchivers_Tar(t *testing.T) {
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a.pdf"), filepath.Join(dir, "b.jpg")
+	assert.NoError(t, os.WriteFile(a, []byte("first file"), 0644))
+	assert.NoError(t, os.WriteFile(b, []byte("second file"), 0644))
+
+	archivers := services.NewArchiverRegistry(t.TempDir())
+	for _, format := range []services.Format{services.FormatTar, services.FormatTarGz, services.FormatTarZst} {
+		got, archiver, err := archivers.Get(format.Name)
+		assert.NoError(t, err)
+		assert.Equal(t, format, got)
+
+		path, err := archiver.CreateArchive([]services.ArchiveFile{{Path: a, Name: "a.pdf"}, {Path: b, Name: "b.jpg"}}, services.ArchiveOptions{})
+		assert.NoError(t, err)
+		assert.True(t, strings.HasSuffix(path, format.Ext))
+		assert.Equal(t, map[string]string{"a.pdf": "first file", "b.jpg": "second file"}, readTarball(t, path, format))
+
+		stream, err := archiver.NewStream(services.ArchiveOptions{Level: 9})
+		assert.NoError(t, err)
+		w, _ := stream.Create("kept.pdf")
+		io.WriteString(w, "kept")
+		w, _ = stream.Create("broken.pdf")
+		io.WriteString(w, "half")
+		stream.Discard()
+		path, err = stream.Close()
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]string{"kept.pdf": "kept"}, readTarball(t, path, format))
+
+		// A file that fails to be read fails the archive instead of leaving a
+		// truncated entry in it.
+		archiveDir := t.TempDir()
+		_, archiver, _ = services.NewArchiverRegistry(archiveDir).Get(format.Name)
+		_, err = archiver.CreateArchive([]services.ArchiveFile{{Path: a, Name: "a.pdf"}, {Path: dir, Name: "dir.pdf"}}, services.ArchiveOptions{})
+		assert.Error(t, err)
+		left, _ := os.ReadDir(archiveDir)
+		assert.Empty(t, left, "the failed archive is removed")
+	}
+
+	_, _, err := archivers.Get("rar")
+	assert.ErrorIs(t, err, services.ErrUnknownFormat)
+}
+
+func TestHandlerCreateTask_Format(t *testing.T) {
+	archivePath := filepath.Join(t.TempDir(), "archive.tar.gz")
+	assert.NoError(t, os.WriteFile(archivePath, []byte("tarball"), 0644))
+
+	store := memorystorage.NewMemoryStorage()
+	logger, _ := zap.NewDevelopment()
+	log := logger.Sugar()
+	defer log.Sync()
+	service := services.NewTaskService(store, log, 3, 3, services.NewArchiverRegistry(t.TempDir()))
+	r := router.NewRouter(service, log)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/task", strings.NewReader(`{"format": "tar.gz"}`)))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var task model.Task
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&task))
+	assert.Equal(t, "tar.gz", task.Format)
+
+	stored, _ := store.Get(context.Background(), task.ID)
+	stored.Status, stored.Archive = model.StatusDone, archivePath
+	store.Update(context.Background(), stored)
+
+	link, err := service.ArchiveLink(context.Background(), task.ID)
+	assert.NoError(t, err)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, link.URL, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/gzip", w.Header().Get("Content-Type"))
+	assert.Equal(t, "attachment; filename="+task.ID+".tar.gz", w.Header().Get("Content-Disposition"))
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/task?format=rar", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestArchivers_ZipCompression(t *testing.T) {
+	dir := t.TempDir()
+	jpg, txt := filepath.Join(dir, "photo.jpg"), filepath.Join(dir, "notes.txt")
+	assert.NoError(t, os.WriteFile(jpg, bytes.Repeat([]byte{0xff, 0xd8, 0xff}, 100), 0644))
+	assert.NoError(t, os.WriteFile(txt, bytes.Repeat([]byte("text "), 100), 0644))
+
+	_, archiver, err := services.NewArchiverRegistry(t.TempDir()).Get("zip")
+	assert.NoError(t, err)
+
+	for compression, want := range map[string][2]uint16{
+		services.CompressionAuto:    {zip.Store, zip.Deflate},
+		services.CompressionStore:   {zip.Store, zip.Store},
+		services.CompressionDeflate: {zip.Deflate, zip.Deflate},
+	} {
+		opts := services.ArchiveOptions{Compression: compression, Level: 1}
+		path, err := archiver.CreateArchive([]services.ArchiveFile{{Path: jpg, Name: "photo.jpg"}, {Path: txt, Name: "notes.txt"}}, opts)
+		assert.NoError(t, err)
+		r, err := zip.OpenReader(path)
+		assert.NoError(t, err)
+		assert.Equal(t, want[0], r.File[0].Method, compression)
+		assert.Equal(t, want[1], r.File[1].Method, compression)
+		r.Close()
+
+		stream, err := archiver.NewStream(opts)
+		assert.NoError(t, err)
+		w, _ := stream.Create("photo.jpg")
+		w.Write([]byte{0xff, 0xd8, 0xff})
+		w, _ = stream.Create("notes.txt")
+		io.WriteString(w, "text")
+		path, err = stream.Close()
+		assert.NoError(t, err)
+		r, err = zip.OpenReader(path)
+		assert.NoError(t, err)
+		assert.Equal(t, want[0], r.File[0].Method, compression)
+		assert.Equal(t, want[1], r.File[1].Method, compression)
+		r.Close()
+	}
+
+	// A file that fails to be read fails the archive instead of leaving a
+	// truncated entry in it.
+	archiveDir := t.TempDir()
+	_, archiver, _ = services.NewArchiverRegistry(archiveDir).Get("zip")
+	_, err = archiver.CreateArchive([]services.ArchiveFile{{Path: jpg, Name: "photo.jpg"}, {Path: dir, Name: "dir.txt"}}, services.ArchiveOptions{})
+	assert.Error(t, err)
+	left, _ := os.ReadDir(archiveDir)
+	assert.Empty(t, left, "the failed archive is removed")
+
+	assert.ErrorIs(t, services.ArchiveOptions{Compression: "lzma"}.Validate(), services.ErrUnknownCompression)
+	assert.ErrorIs(t, services.ArchiveOptions{Level: 10}.Validate(), services.ErrBadCompressionLevel)
+}
+
+// decryptZipEntry reads a WinZip AE-2 entry, checking the password verifier
+// and the authentication code.
+func decryptZipEntry(f *zip.File, password string) ([]byte, error) {
+	if f.Method != 99 || len(f.Extra) < 11 || binary.LittleEndian.Uint16(f.Extra[len(f.Extra)-11:]) != 0x9901 {
+		return nil, errors.New("entry is not AES encrypted")
+	}
+	method := binary.LittleEndian.Uint16(f.Extra[len(f.Extra)-2:])
+	r, err := f.OpenRaw()
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	salt, verifier, body, code := data[:16], data[16:18], data[18:len(data)-10], data[len(data)-10:]
+
+	var keys []byte
+	for block := uint32(1); len(keys) < 66; block++ {
+		prf := hmac.New(sha1.New, []byte(password))
+		prf.Write(salt)
+		prf.Write(binary.BigEndian.AppendUint32(nil, block))
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < 1000; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(nil)
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		keys = append(keys, t...)
+	}
+	if !bytes.Equal(keys[64:66], verifier) {
+		return nil, errors.New("wrong password")
+	}
+	mac := hmac.New(sha1.New, keys[32:64])
+	mac.Write(body)
+	if !hmac.Equal(mac.Sum(nil)[:10], code) {
+		return nil, errors.New("authentication failed")
+	}
+
+	block, _ := aes.NewCipher(keys[:32])
+	plain := make([]byte, len(body))
+	counter, stream := make([]byte, 16), make([]byte, 16)
+	for i := range body {
+		if i%16 == 0 {
+			binary.LittleEndian.PutUint64(counter, uint64(i/16+1))
+			block.Encrypt(stream, counter)
+		}
+		plain[i] = body[i] ^ stream[i%16]
+	}
+	if method == zip.Deflate {
+		return io.ReadAll(flate.NewReader(bytes.NewReader(plain)))
+	}
+	return plain, nil
+}
+
+func TestServiceEncryptedArchive(t *testing.T) {
+	data := bytes.Repeat([]byte("%PDF- confidential scan "), 100)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	store := memorystorage.NewMemoryStorage()
+	logger, _ := zap.NewDevelopment()
+	log := logger.Sugar()
+	defer log.Sync()
+	service := services.NewTaskService(store, log, 3, 3, services.NewArchiverRegistry(t.TempDir()),
+		services.WithPasswordKey([]byte("key")),
+		services.WithCompression(services.ArchiveOptions{Compression: services.CompressionDeflate}))
+
+	_, err := service.CreateTask(ctx, model.TaskOptions{Format: "tar", Encrypt: true})
+	assert.ErrorIs(t, err, services.ErrEncryptionUnsupported)
+
+	created, err := service.CreateTask(ctx, model.TaskOptions{Encrypt: true})
+	assert.NoError(t, err)
+	password := created.Password
+	assert.NotEmpty(t, password)
+
+	stored, _ := store.Get(ctx, created.ID)
+	assert.Empty(t, stored.Password)
+	assert.NotEmpty(t, stored.SealedPassword)
+	assert.False(t, bytes.Contains(stored.SealedPassword, []byte(password)))
+	got, _ := service.GetTask(ctx, created.ID)
+	assert.Empty(t, got.Password)
+
+	assert.NoError(t, service.AddLinks(ctx, created.ID, []string{srv.URL + "/scan.pdf"}))
+	assert.NoError(t, service.SubmitTask(ctx, created.ID))
+	go service.Start(ctx)
+
+	assert.Eventually(t, func() bool {
+		task, _ := service.GetTask(ctx, created.ID)
+		return task.Status == model.StatusDone
+	}, 5*time.Second, 10*time.Millisecond)
+
+	task, _ := store.Get(ctx, created.ID)
+	assert.Empty(t, task.SealedPassword)
+	r, err := zip.OpenReader(task.Archive)
+	assert.NoError(t, err)
+	defer r.Close()
+	assert.Equal(t, 1, len(r.File))
+
+	content, err := decryptZipEntry(r.File[0], password)
+	assert.NoError(t, err)
+	assert.Equal(t, data, content)
+	_, err = decryptZipEntry(r.File[0], "wrong")
+	assert.Error(t, err)
+
+	// A task that won't be archived drops its password as well.
+	canceled, err := service.CreateTask(ctx, model.TaskOptions{Encrypt: true})
+	assert.NoError(t, err)
+	assert.NoError(t, service.CancelTask(ctx, canceled.ID))
+	task, _ = store.Get(ctx, canceled.ID)
+	assert.Equal(t, model.StatusCanceled, task.Status)
+	assert.Empty(t, task.SealedPassword)
+}
+
+func TestServiceManifest(t *testing.T) {
+	data := []byte("%PDF-1.4 report")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing.pdf" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Write(data)
+	}))
+	defer srv.Close()
+	sum := sha256.Sum256(data)
+	wantSum := hex.EncodeToString(sum[:])
+
+	for _, streaming := range []bool{false, true} {
+		ctx, cancel := context.WithCancel(context.Background())
+		store := memorystorage.NewMemoryStorage()
+		logger, _ := zap.NewDevelopment()
+		log := logger.Sugar()
+		service := services.NewTaskService(store, log, 3, 3, services.NewArchiverRegistry(t.TempDir()),
+			services.WithStreaming(streaming), services.WithManifest(true), services.WithDownloadDir(t.TempDir()))
+
+		created, err := service.CreateTask(ctx, model.TaskOptions{})
+		assert.NoError(t, err)
+		good, missing := srv.URL+"/report.pdf", srv.URL+"/missing.pdf"
+		assert.NoError(t, service.AddLinks(ctx, created.ID, []string{good, missing}))
+		assert.NoError(t, service.SubmitTask(ctx, created.ID))
+		go service.Start(ctx)
+
+		assert.Eventually(t, func() bool {
+			task, _ := service.GetTask(ctx, created.ID)
+			return task.Status == model.StatusDone
+		}, 5*time.Second, 10*time.Millisecond)
+		cancel()
+
+		task, _ := store.Get(context.Background(), created.ID)
+		r, err := zip.OpenReader(task.Archive)
+		assert.NoError(t, err)
+		entries := make(map[string][]byte)
+		for _, f := range r.File {
+			rc, _ := f.Open()
+			entries[f.Name], _ = io.ReadAll(rc)
+			rc.Close()
+		}
+		// Counted on the archive, as duplicate entries collapse in the map.
+		assert.Equal(t, 3, len(r.File))
+		r.Close()
+		assert.Equal(t, 3, len(entries))
+
+		var manifest struct {
+			TaskID string `json:"task_id"`
+			Files  []struct {
+				URL          string     `json:"url"`
+				Entry        string     `json:"entry"`
+				Size         int64      `json:"size"`
+				ContentType  string     `json:"content_type"`
+				SHA256       string     `json:"sha256"`
+				DownloadedAt *time.Time `json:"downloaded_at"`
+				StatusCode   int        `json:"status_code"`
+				Error        string     `json:"error"`
+			} `json:"files"`
+		}
+		assert.NoError(t, json.Unmarshal(entries["manifest.json"], &manifest))
+		assert.Equal(t, created.ID, manifest.TaskID)
+		assert.Equal(t, 2, len(manifest.Files))
+
+		ok := manifest.Files[0]
+		assert.Equal(t, good, ok.URL)
+		assert.Equal(t, data, entries[ok.Entry])
+		assert.Equal(t, int64(len(data)), ok.Size)
+		assert.Equal(t, "application/pdf", ok.ContentType)
+		assert.Equal(t, wantSum, ok.SHA256)
+		assert.NotNil(t, ok.DownloadedAt)
+		assert.Equal(t, http.StatusOK, ok.StatusCode)
+		assert.Empty(t, ok.Error)
+
+		failed := manifest.Files[1]
+		assert.Equal(t, missing, failed.URL)
+		assert.Empty(t, failed.Entry)
+		assert.Equal(t, http.StatusNotFound, failed.StatusCode)
+		assert.Contains(t, failed.Error, "404")
+
+		assert.Equal(t, wantSum+"  "+ok.Entry+"\n", string(entries["SHA256SUMS"]))
+		log.Sync()
+	}
+}
+
+func TestServiceEntryNames(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/files/1.pdf":
+			w.Header().Set("Content-Disposition", `attachment; filename="invoice.pdf"`)
+		case "/files/2.pdf":
+			w.Header().Set("Content-Disposition", `attachment; filename*=UTF-8''%D1%81%D1%87%D0%B5%D1%82%3A2025.pdf`)
+		case "/files/3.pdf":
+			w.Header().Set("Content-Disposition", `attachment; filename="CON.pdf"`)
+		case "/files/5.pdf":
+			w.Header().Set("Content-Disposition", `attachment; filename="c.`+strings.Repeat("x", 300)+`"`)
+		}
+		io.WriteString(w, "%PDF-"+r.URL.Path)
+	}))
+	defer srv.Close()
+
+	links := []string{
+		srv.URL + "/files/1.pdf",
+		srv.URL + "/other/INVOICE.pdf",
+		srv.URL + "/files/2.pdf",
+		srv.URL + "/files/3.pdf",
+		srv.URL + "/files/4.pdf",
+		srv.URL + "/files/5.pdf",
+		srv.URL + "/files/6.pdf",
+		srv.URL + "/files/7.pdf",
+	}
+	// An extension too long to keep is cut as part of the name.
+	longName := "a." + strings.Repeat("b", 300)
+	want := map[string]string{
+		"invoice.pdf":                                "/files/1.pdf",
+		"INVOICE (1).pdf":                            "/other/INVOICE.pdf",
+		"счет_2025.pdf":                              "/files/2.pdf",
+		"_CON.pdf":                                   "/files/3.pdf",
+		"passwd.pdf":                                 "/files/4.pdf",
+		"c." + strings.Repeat("x", 249) + ".pdf":     "/files/5.pdf",
+		"a." + strings.Repeat("b", 249) + ".pdf":     "/files/6.pdf",
+		"a." + strings.Repeat("b", 245) + " (1).pdf": "/files/7.pdf",
+	}
+
+	for _, streaming := range []bool{false, true} {
+		ctx, cancel := context.WithCancel(context.Background())
+		store := memorystorage.NewMemoryStorage()
+		logger, _ := zap.NewDevelopment()
+		log := logger.Sugar()
+		service := services.NewTaskService(store, log, 3, 8, services.NewArchiverRegistry(t.TempDir()),
+			services.WithStreaming(streaming), services.WithWorkers(1, 3), services.WithDownloadDir(t.TempDir()))
+
+		created, err := service.CreateTask(ctx, model.TaskOptions{})
+		assert.NoError(t, err)
+		err = service.AddNamedLinks(ctx, created.ID, links[:1], map[string]string{srv.URL + "/files/4.pdf": "x.pdf"})
+		assert.ErrorIs(t, err, services.ErrBadEntryName)
+		err = service.AddNamedLinks(ctx, created.ID, links, map[string]string{
+			links[4]: "../../etc/passwd.pdf",
+			links[6]: longName,
+			links[7]: longName,
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, service.SubmitTask(ctx, created.ID))
+		go service.Start(ctx)
+
+		assert.Eventually(t, func() bool {
+			task, _ := service.GetTask(ctx, created.ID)
+			return task.Status == model.StatusDone
+		}, 5*time.Second, 10*time.Millisecond)
+		cancel()
+
+		task, _ := store.Get(context.Background(), created.ID)
+		r, err := zip.OpenReader(task.Archive)
+		assert.NoError(t, err)
+		got := make(map[string]string)
+		for _, f := range r.File {
+			rc, _ := f.Open()
+			data, _ := io.ReadAll(rc)
+			rc.Close()
+			got[f.Name] = strings.TrimPrefix(string(data), "%PDF-")
+		}
+		r.Close()
+		assert.Equal(t, want, got, "streaming: %v", streaming)
+		log.Sync()
+	}
+}
+
+type countingStorage struct {
+	services.TaskStorage
+	updates atomic.Int32
+}
+
+func (s *countingStorage) Update(ctx context.Context, task model.Task) error {
+	s.updates.Add(1)
+	return s.TaskStorage.Update(ctx, task)
+}
+
+func TestServiceProgress(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "10000")
+		if r.Method == http.MethodHead {
+			return
+		}
+		chunk := []byte("%PDF-" + strings.Repeat("x", 995))
+		for range 5 {
+			w.Write(chunk)
+			w.(http.Flusher).Flush()
+			time.Sleep(150 * time.Millisecond)
+		}
+		<-release
+		for range 100 {
+			w.Write(chunk[:50])
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer srv.Close()
+
+	store := &countingStorage{TaskStorage: memorystorage.NewMemoryStorage()}
+	logger, _ := zap.NewDevelopment()
+	log := logger.Sugar()
+	defer log.Sync()
+	service := services.NewTaskService(store, log, 1, 1, newMockArchivers(),
+		services.WithProgressInterval(time.Hour), services.WithDownloadDir(t.TempDir()))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	link := srv.URL + "/file.pdf"
+	created, err := service.CreateTask(ctx, model.TaskOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, service.AddLinks(ctx, created.ID, []string{link}))
+	assert.NoError(t, service.SubmitTask(ctx, created.ID))
+	go service.Start(ctx)
+
+	var live model.Progress
+	assert.Eventually(t, func() bool {
+		task, _ := service.GetTask(ctx, created.ID)
+		if task.Progress == nil {
+			return false
+		}
+		live = task.Progress.Links[link]
+		return live.Received == 5000 && live.Throughput > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, int64(10000), live.Total)
+	assert.Equal(t, 50.0, live.Percent)
+	assert.Positive(t, live.ETA)
+	assert.False(t, live.Done)
+
+	stored, _ := store.Get(ctx, created.ID)
+	assert.Nil(t, stored.Progress, "progress is saved once per interval")
+	writes := store.updates.Load()
+	close(release)
+
+	assert.Eventually(t, func() bool {
+		task, _ := service.GetTask(ctx, created.ID)
+		return task.Status == model.StatusDone
+	}, 5*time.Second, 10*time.Millisecond)
+	stored, _ = store.Get(ctx, created.ID)
+	assert.Equal(t, model.Progress{Received: 10000, Total: 10000, Percent: 100, Done: true}, stored.Progress.Progress)
+	assert.Less(t, store.updates.Load()-writes, int32(10), "progress of every write isn't saved")
+}
+
+type sseEvent struct {
+	ID, Event, Data string
+}
+
+func openEvents(t *testing.T, url, lastEventID string) *http.Response {
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	return resp
+}
+
+// readEvents reads an event stream until it is closed.
+func readEvents(resp *http.Response) []sseEvent {
+	defer resp.Body.Close()
+	var events []sseEvent
+	var ev sseEvent
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		field, value, _ := strings.Cut(scanner.Text(), ": ")
+		switch field {
+		case "id":
+			ev.ID = value
+		case "event":
+			ev.Event = value
+		case "data":
+			ev.Data = value
+		case "":
+			events = append(events, ev)
+			ev = sseEvent{}
+		}
+	}
+	return events
+}
+
+func TestHandlerTaskEvents(t *testing.T) {
+	release := make(chan struct{})
+	files := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/broken.pdf" {
+			http.NotFound(w, r)
+			return
+		}
+		<-release
+		io.WriteString(w, "%PDF-")
+	}))
+	defer files.Close()
+
+	store := memorystorage.NewMemoryStorage()
+	logger, _ := zap.NewDevelopment()
+	log := logger.Sugar()
+	defer log.Sync()
+	service := services.NewTaskService(store, log, 1, 2, newMockArchivers(),
+		services.WithWorkers(1, 2),
+		services.WithRetryPolicy(services.RetryPolicy{MaxAttempts: 1}),
+		services.WithDownloadDir(t.TempDir()))
+	srv := httptest.NewServer(router.NewRouter(service, log))
+	defer srv.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	resp, err := http.Get(srv.URL + "/task/missing/events")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	created, err := service.CreateTask(ctx, model.TaskOptions{})
+	assert.NoError(t, err)
+	links := []string{files.URL + "/file.pdf", files.URL + "/broken.pdf"}
+	assert.NoError(t, service.AddLinks(ctx, created.ID, links))
+	go service.Start(ctx)
+
+	url := srv.URL + "/task/" + created.ID + "/events"
+	stream := make(chan []sseEvent)
+	go func(resp *http.Response) { stream <- readEvents(resp) }(openEvents(t, url, ""))
+	assert.NoError(t, service.SubmitTask(ctx, created.ID))
+	assert.Eventually(t, func() bool {
+		task, _ := service.GetTask(ctx, created.ID)
+		return len(task.FailedLinks) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	close(release)
+	events := <-stream
+
+	var statuses []string
+	var failed, done services.LinkEvent
+	var progress model.TaskProgress
+	for _, ev := range events {
+		switch ev.Event {
+		case services.EventStatus:
+			var task model.Task
+			assert.NoError(t, json.Unmarshal([]byte(ev.Data), &task))
+			statuses = append(statuses, task.Status)
+			if task.Status == model.StatusDone {
+				assert.Contains(t, task.ArchiveURL, "/task/"+created.ID+"/archive?")
+			}
+		case services.EventLinkFailed:
+			assert.NoError(t, json.Unmarshal([]byte(ev.Data), &failed))
+		case services.EventLinkDone:
+			assert.NoError(t, json.Unmarshal([]byte(ev.Data), &done))
+		case services.EventProgress:
+			assert.NoError(t, json.Unmarshal([]byte(ev.Data), &progress))
+		}
+	}
+	assert.Contains(t, progress.Links, links[0])
+	assert.Equal(t, []string{model.StatusCollecting, model.StatusQueued, model.StatusRunning, model.StatusArchiving, model.StatusDone}, statuses)
+	assert.Equal(t, links[1], failed.URL)
+	assert.Contains(t, failed.Error, "404")
+	assert.Equal(t, services.LinkEvent{URL: links[0], Size: 5, ContentType: "application/pdf", SHA256: fmt.Sprintf("%x", sha256.Sum256([]byte("%PDF-")))}, done)
+	assert.Equal(t, "1", events[0].ID, "stream starts with the current task")
+	for i := 1; i < len(events); i++ {
+		assert.Equal(t, fmt.Sprint(i+1), events[i].ID)
+	}
+
+	resumed := readEvents(openEvents(t, url, events[2].ID))
+	assert.Equal(t, events[3:], resumed)
+
+	snapshot := readEvents(openEvents(t, url, ""))
+	assert.Len(t, snapshot, 1)
+	assert.Equal(t, events[len(events)-1].ID, snapshot[0].ID)
+	assert.Contains(t, snapshot[0].Data, `"status":"done"`)
+}
+
+func TestServiceCallbacks(t *testing.T) {
+	files := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "%PDF-")
+	}))
+	defer files.Close()
+
+	type delivery struct {
+		task      model.Task
+		signature string
+	}
+	deliveries := make(chan delivery, 10)
+	var calls atomic.Int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write([]byte(r.Header.Get(services.TimestampHeader) + "." + string(body)))
+		assert.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), r.Header.Get(services.SignatureHeader))
+
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var task model.Task
+		assert.NoError(t, json.Unmarshal(body, &task))
+		deliveries <- delivery{task, r.Header.Get(services.SignatureHeader)}
+	}))
+	defer receiver.Close()
+
+	store := memorystorage.NewMemoryStorage()
+	pending := time.Now()
+	store.Store(context.Background(), &model.Task{
+		ID: "left-over", Status: model.StatusFailed, TaskOptions: model.TaskOptions{CallbackURL: receiver.URL + "/left-over"},
+		Callback: &model.Delivery{Status: model.DeliveryPending, NextAttemptAt: &pending},
+	})
+	logger, _ := zap.NewDevelopment()
+	log := logger.Sugar()
+	defer log.Sync()
+	service := services.NewTaskService(store, log, 3, 1, newMockArchivers(),
+		services.WithDownloadDir(t.TempDir()),
+		services.WithWebhooks(services.WebhookConfig{
+			Secret:  []byte("secret"),
+			Timeout: time.Second,
+			Retry:   services.RetryPolicy{MaxAttempts: 3, BaseDelay: 50 * time.Millisecond, MaxDelay: time.Second},
+		}))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, err := service.CreateTask(ctx, model.TaskOptions{CallbackURL: "ftp://example.com/hook"})
+	assert.ErrorIs(t, err, services.ErrBadCallbackURL)
+
+	go service.Start(ctx)
+	select {
+	case d := <-deliveries:
+		assert.Equal(t, "left-over", d.task.ID)
+	case <-time.After(5 * time.Second):
+		t.Fatal("pending callback is not delivered after restart")
+	}
+
+	created, err := service.CreateTask(ctx, model.TaskOptions{CallbackURL: receiver.URL + "/hook"})
+	assert.NoError(t, err)
+	assert.NoError(t, service.AddLinks(ctx, created.ID, []string{files.URL + "/file.pdf"}))
+	assert.NoError(t, service.SubmitTask(ctx, created.ID))
+	select {
+	case d := <-deliveries:
+		assert.Equal(t, created.ID, d.task.ID)
+		assert.Equal(t, model.StatusDone, d.task.Status)
+		assert.Contains(t, d.task.ArchiveURL, "/task/"+created.ID+"/archive?")
+	case <-time.After(5 * time.Second):
+		t.Fatal("callback is not delivered")
+	}
+
+	assert.Eventually(t, func() bool {
+		task, _ := service.GetTask(ctx, created.ID)
+		return task.Callback.Status == model.DeliveryDelivered
+	}, 5*time.Second, 10*time.Millisecond)
+	task, _ := service.GetTask(ctx, "left-over")
+	assert.Equal(t, model.DeliveryDelivered, task.Callback.Status)
+	assert.Len(t, task.Callback.Attempts, 2)
+	assert.Equal(t, http.StatusServiceUnavailable, task.Callback.Attempts[0].StatusCode)
+	assert.Nil(t, task.Callback.NextAttemptAt)
+
+	created, err = service.CreateTask(ctx, model.TaskOptions{CallbackURL: receiver.URL + "/gone"})
+	assert.NoError(t, err)
+	receiver.Close()
+	assert.NoError(t, service.CancelTask(ctx, created.ID))
+	assert.Eventually(t, func() bool {
+		task, _ := service.GetTask(ctx, created.ID)
+		return task.Callback.Status == model.DeliveryFailed
+	}, 5*time.Second, 10*time.Millisecond)
+	task, _ = service.GetTask(ctx, created.ID)
+	assert.Len(t, task.Callback.Attempts, 3)
+}
+
+func TestServiceContentCheck(t *testing.T) {
+	pdf := []byte("%PDF-1.7\n" + strings.Repeat("0", 2000))
+	jpeg := append([]byte{0xFF, 0xD8, 0xFF, 0xE0}, bytes.Repeat([]byte{0}, 2000)...)
+	html := []byte("<!DOCTYPE html><html><body>Please log in</body></html>")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, contentType := pdf, "application/octet-stream"
+		switch r.URL.Path {
+		case "/login.pdf", "/page":
+			content, contentType = html, "text/html; charset=utf-8"
+		case "/fake.pdf":
+			content = jpeg
+		case "/photo":
+			content, contentType = jpeg, "image/jpeg"
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "", time.Unix(0, 0), bytes.NewReader(content))
+	}))
+	defer srv.Close()
+
+	links := []string{srv.URL + "/login.pdf", srv.URL + "/fake.pdf", srv.URL + "/page", srv.URL + "/download", srv.URL + "/photo"}
+	modes := map[string][]services.Option{
+		"file":      nil,
+		"chunked":   {services.WithDownloader(downloader.New(downloader.Config{Chunks: 2, MinChunkSize: 1}))},
+		"streaming": {services.WithStreaming(true)},
+	}
+	for mode, opts := range modes {
+		ctx, cancel := context.WithCancel(context.Background())
+		store := memorystorage.NewMemoryStorage()
+		logger, _ := zap.NewDevelopment()
+		log := logger.Sugar()
+		opts = append(opts, services.WithWorkers(1, 5), services.WithDownloadDir(t.TempDir()))
+		service := services.NewTaskService(store, log, 3, 5, services.NewArchiverRegistry(t.TempDir()), opts...)
+
+		created, err := service.CreateTask(ctx, model.TaskOptions{})
+		assert.NoError(t, err)
+		assert.NoError(t, service.AddLinks(ctx, created.ID, links))
+		assert.NoError(t, service.SubmitTask(ctx, created.ID))
+		go service.Start(ctx)
+
+		assert.Eventually(t, func() bool {
+			task, _ := service.GetTask(ctx, created.ID)
+			return task.Status == model.StatusDone
+		}, 5*time.Second, 10*time.Millisecond, mode)
+		cancel()
+
+		task, _ := store.Get(context.Background(), created.ID)
+		assert.Len(t, task.FailedLinks, 3, mode)
+		assert.Contains(t, task.FailedLinks[links[0]], "server sent text/html, expected pdf", mode)
+		assert.Contains(t, task.FailedLinks[links[1]], "content looks like image/jpeg, expected pdf", mode)
+		assert.Contains(t, task.FailedLinks[links[2]], "server sent text/html, expected pdf or jpeg", mode)
+		for _, link := range links[:3] {
+			assert.Len(t, task.Attempts[link], 1, "mismatches are not retried")
+		}
+		assert.Equal(t, "application/pdf", task.Downloads[links[3]].ContentType, mode)
+
+		r, err := zip.OpenReader(task.Archive)
+		assert.NoError(t, err)
+		got := make(map[string]int)
+		for _, f := range r.File {
+			got[f.Name] = int(f.UncompressedSize64)
+		}
+		r.Close()
+		assert.Equal(t, map[string]int{"download.pdf": len(pdf), "photo.jpg": len(jpeg)}, got, mode)
+		log.Sync()
+	}
+}
+
+func TestServiceFileTypes(t *testing.T) {
+	_, err := services.FileTypesByName([]string{"pdf", "exe"})
+	assert.ErrorIs(t, err, services.ErrBadFileType)
+
+	path := filepath.Join(t.TempDir(), "types.json")
+	assert.NoError(t, os.WriteFile(path, []byte(`[{"name": "bad", "extensions": [".bad"], "magic": ["zz"]}]`), 0644))
+	_, err = services.LoadFileTypes(path)
+	assert.ErrorIs(t, err, services.ErrBadFileType)
+
+	assert.NoError(t, os.WriteFile(path, []byte(`[
+		{"name": "png", "max_size": 1000},
+		{"name": "csv"},
+		{"name": "webp"},
+		{"name": "dat", "extensions": ["dat"], "mime_types": ["application/x-dat"], "magic": ["4441 ?? 41"]}
+	]`), 0644))
+	types, err := services.LoadFileTypes(path)
+	assert.NoError(t, err)
+
+	png := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0}, 500)...)
+	bigPNG := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0}, 5000)...)
+	webp := append([]byte("RIFF\x10\x00\x00\x00WEBPVP8 "), bytes.Repeat([]byte{0}, 100)...)
+	csv := []byte("id,name\n1,a\n2,b\n")
+	dat := []byte("DAXA-data")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/small.png":
+			w.Write(png)
+		case "/big.png":
+			w.Header().Set("Content-Length", strconv.Itoa(len(bigPNG)))
+			w.Write(bigPNG)
+		case "/unsized.png":
+			for i := 0; i < len(bigPNG); i += 500 {
+				w.Write(bigPNG[i:min(i+500, len(bigPNG))])
+				w.(http.Flusher).Flush()
+			}
+		case "/image":
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write(webp)
+		case "/table.csv":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write(csv)
+		case "/file.dat":
+			w.Header().Set("Content-Type", "application/x-dat")
+			w.Write(dat)
+		}
+	}))
+	defer srv.Close()
+
+	links := []string{srv.URL + "/small.png", srv.URL + "/big.png", srv.URL + "/unsized.png", srv.URL + "/image", srv.URL + "/table.csv", srv.URL + "/file.dat"}
+	for _, streaming := range []bool{false, true} {
+		ctx, cancel := context.WithCancel(context.Background())
+		store := memorystorage.NewMemoryStorage()
+		logger, _ := zap.NewDevelopment()
+		log := logger.Sugar()
+		service := services.NewTaskService(store, log, 3, 6, services.NewArchiverRegistry(t.TempDir()),
+			services.WithFileTypes(types), services.WithStreaming(streaming), services.WithWorkers(1, 6), services.WithDownloadDir(t.TempDir()))
+
+		created, err := service.CreateTask(ctx, model.TaskOptions{})
+		assert.NoError(t, err)
+		err = service.AddLinks(ctx, created.ID, []string{srv.URL + "/a.pdf", srv.URL + "/b.png"})
+		var rejected *services.RejectedLinksError
+		assert.ErrorAs(t, err, &rejected)
+		assert.Equal(t, map[string]string{
+			srv.URL + "/a.pdf": "extension .pdf is not allowed, allowed are .png, .csv, .webp, .dat or none",
+		}, rejected.Links)
+
+		assert.NoError(t, service.AddLinks(ctx, created.ID, links))
+		assert.NoError(t, service.SubmitTask(ctx, created.ID))
+		go service.Start(ctx)
+
+		assert.Eventually(t, func() bool {
+			task, _ := service.GetTask(ctx, created.ID)
+			return task.Status == model.StatusDone
+		}, 5*time.Second, 10*time.Millisecond)
+		cancel()
+
+		task, _ := store.Get(context.Background(), created.ID)
+		assert.Equal(t, map[string]string{
+			links[1]: "file is too large: 5008 bytes, limit is 1000",
+			links[2]: "file is too large: more than 1000 bytes",
+		}, task.FailedLinks)
+		assert.Len(t, task.Attempts[links[2]], 1, "files too large are not retried")
+
+		r, err := zip.OpenReader(task.Archive)
+		assert.NoError(t, err)
+		got := make(map[string]int)
+		for _, f := range r.File {
+			got[f.Name] = int(f.UncompressedSize64)
+		}
+		r.Close()
+		assert.Equal(t, map[string]int{"small.png": len(png), "image.webp": len(webp), "table.csv": len(csv), "file.dat": len(dat)}, got)
+		log.Sync()
+	}
+}
+
+func TestHandlerAddLinks_Rejected(t *testing.T) {
+	store := newMockStorage()
+	logger, _ := zap.NewDevelopment()
+	log := logger.Sugar()
+	defer log.Sync()
+	service := services.NewTaskService(store, log, 3, 3, newMockArchivers())
+	created, _ := service.CreateTask(context.Background(), model.TaskOptions{})
+
+	body := `{"links": ["https://example.com/a.pdf", "https://example.com/setup.exe", "https://example.com/run.sh"]}`
+	req := httptest.NewRequest(http.MethodPatch, "/task/"+created.ID, strings.NewReader(body))
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, &chi.Context{
+		URLParams: chi.RouteParams{
+			Keys:   []string{"id"},
+			Values: []string{created.ID},
+		},
+	}))
+	w := httptest.NewRecorder()
+	router.AddLinks(service, log).ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	var resp router.RejectedLinks
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	assert.Equal(t, services.ErrNotValidExaction.Error(), resp.Error)
+	assert.Equal(t, map[string]string{
+		"https://example.com/setup.exe": "extension .exe is not allowed, allowed are .pdf, .jpg, .jpeg or none",
+		"https://example.com/run.sh":    "extension .sh is not allowed, allowed are .pdf, .jpg, .jpeg or none",
+	}, resp.Links)
+
+	task, _ := store.Get(context.Background(), created.ID)
+	assert.Empty(t, task.Links)
+}
+
+func TestNetGuard(t *testing.T) {
+	_, err := netguard.New(netguard.Config{Allow: []string{"10.0.0.0/33"}})
+	assert.Error(t, err)
+
+	pdf := []byte("%PDF-1.7\n")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "http://"+r.Host+"/file.pdf", http.StatusFound)
+			return
+		}
+		if r.URL.Path == "/to-ip" {
+			_, port, _ := net.SplitHostPort(r.Host)
+			http.Redirect(w, r, "http://127.0.0.1:"+port+"/file.pdf", http.StatusFound)
+			return
+		}
+		w.Write(pdf)
+	}))
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	byIP := "http://127.0.0.1:" + port
+	byName := "http://localhost:" + port
+
+	var blocked []string
+	var mu sync.Mutex
+	logf := func(template string, args ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		blocked = append(blocked, fmt.Sprintf(template, args...))
+	}
+	fetch := func(guard *netguard.Guard, url string) error {
+		d := downloader.New(downloader.Config{Client: guard.Client()})
+		st := &downloader.State{Path: filepath.Join(t.TempDir(), "file")}
+		return d.Resume(context.Background(), url, st)
+	}
+
+	guard, err := netguard.New(netguard.Config{Logf: logf})
+	assert.NoError(t, err)
+	assert.ErrorIs(t, guard.CheckURL("http://169.254.169.254/latest/meta-data/"), netguard.ErrBlocked)
+	assert.ErrorIs(t, guard.CheckURL("http://[::ffff:10.0.0.1]/a.pdf"), netguard.ErrBlocked)
+	assert.NoError(t, guard.CheckURL("https://example.com/a.pdf"))
+	for _, u := range []string{
+		"http://192.0.0.8/",
+		"http://198.18.0.1/",
+		"http://198.19.255.254/",
+		"http://[64:ff9b::a9fe:a9fe]/",
+		"http://[64:ff9b::7f00:1]/",
+		"http://[64:ff9b:1::1]/",
+		"http://[2002:a9fe:a9fe::1]/",
+		"http://[2002:0a00:0001::]/",
+	} {
+		assert.ErrorIs(t, guard.CheckURL(u), netguard.ErrBlocked, u)
+	}
+	// NAT64 and 6to4 addresses of public hosts are fine.
+	assert.NoError(t, guard.CheckURL("http://[64:ff9b::5db8:d822]/a.pdf"))
+	assert.NoError(t, guard.CheckURL("http://[2002:5db8:d822::1]/a.pdf"))
+	assert.ErrorIs(t, fetch(guard, byIP+"/file.pdf"), netguard.ErrBlocked)
+	assert.ErrorIs(t, fetch(guard, byName+"/file.pdf"), netguard.ErrBlocked, "checked after the name is resolved")
+	assert.GreaterOrEqual(t, len(blocked), 4)
+	assert.Contains(t, blocked[0], "169.254.169.254 is link-local")
+
+	guard, err = netguard.New(netguard.Config{Allow: []string{"localhost"}, Logf: logf})
+	assert.NoError(t, err)
+	assert.NoError(t, fetch(guard, byName+"/file.pdf"))
+	assert.NoError(t, fetch(guard, byName+"/redirect"))
+	assert.ErrorIs(t, fetch(guard, byName+"/to-ip"), netguard.ErrBlocked, "checked on redirect")
+
+	guard, err = netguard.New(netguard.Config{Allow: []string{"127.0.0.0/8"}, Deny: []string{"*.internal", "localhost"}, Logf: logf})
+	assert.NoError(t, err)
+	assert.NoError(t, fetch(guard, byIP+"/file.pdf"))
+	assert.ErrorIs(t, fetch(guard, byName+"/file.pdf"), netguard.ErrBlocked, "deny wins over allow")
+	assert.ErrorIs(t, guard.CheckURL("http://files.internal/a.pdf"), netguard.ErrBlocked)
+}
+
+func TestServiceNetGuard(t *testing.T) {
+	store := newMockStorage()
+	logger, _ := zap.NewDevelopment()
+	log := logger.Sugar()
+	defer log.Sync()
+	guard, err := netguard.New(netguard.Config{Logf: log.Warnf})
+	assert.NoError(t, err)
+	service := services.NewTaskService(store, log, 3, 3, newMockArchivers(), services.WithNetGuard(guard))
+	ctx := context.Background()
+
+	_, err = service.CreateTask(ctx, model.TaskOptions{CallbackURL: "http://10.0.0.1/hook"})
+	assert.ErrorIs(t, err, services.ErrBadCallbackURL)
+	_, err = service.CreateTask(ctx, model.TaskOptions{CallbackURL: "https://example.com/hook"})
+	assert.ErrorIs(t, err, services.ErrCallbacksDisabled, "callbacks can't be signed without a secret")
+
+	created, err := service.CreateTask(ctx, model.TaskOptions{})
+	assert.NoError(t, err)
+	err = service.AddLinks(ctx, created.ID, []string{"http://169.254.169.254/latest/meta-data/", "example.com/a.pdf", "https://example.com/a.pdf"})
+	var rejected *services.RejectedLinksError
+	assert.ErrorAs(t, err, &rejected)
+	assert.Equal(t, map[string]string{
+		"http://169.254.169.254/latest/meta-data/": "address is blocked: 169.254.169.254: 169.254.169.254 is link-local",
+		"example.com/a.pdf":                        "not a valid url",
+	}, rejected.Links)
+}
+
+func TestServiceSizeLimits(t *testing.T) {
+	file := func(size int) []byte {
+		return append([]byte("%PDF-"), bytes.Repeat([]byte("0"), size-5)...)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/big.pdf":
+			w.Header().Set("Content-Length", "3000")
+			w.Write(file(3000))
+		case "/unsized.pdf", "/rest.pdf":
+			content := file(3000)
+			if r.URL.Path == "/rest.pdf" {
+				content = file(300)
+			}
+			for i := 0; i < len(content); i += 100 {
+				w.Write(content[i:min(i+100, len(content))])
+				w.(http.Flusher).Flush()
+			}
+		default:
+			w.Write(file(400))
+		}
+	}))
+	defer srv.Close()
+
+	links := []string{srv.URL + "/a.pdf", srv.URL + "/big.pdf", srv.URL + "/unsized.pdf", srv.URL + "/b.pdf", srv.URL + "/c.pdf", srv.URL + "/rest.pdf"}
+	for _, streaming := range []bool{false, true} {
+		ctx, cancel := context.WithCancel(context.Background())
+		store := memorystorage.NewMemoryStorage()
+		logger, _ := zap.NewDevelopment()
+		log := logger.Sugar()
+		service := services.NewTaskService(store, log, 3, 6, services.NewArchiverRegistry(t.TempDir()),
+			services.WithSizeLimits(500, 1000), services.WithStreaming(streaming), services.WithWorkers(1, 1), services.WithDownloadDir(t.TempDir()))
+
+		created, err := service.CreateTask(ctx, model.TaskOptions{})
+		assert.NoError(t, err)
+		assert.NoError(t, service.AddLinks(ctx, created.ID, links))
+		assert.NoError(t, service.SubmitTask(ctx, created.ID))
+		go service.Start(ctx)
+
+		assert.Eventually(t, func() bool {
+			task, _ := service.GetTask(ctx, created.ID)
+			return task.Status == model.StatusDone
+		}, 5*time.Second, 10*time.Millisecond)
+		cancel()
+
+		task, _ := store.Get(context.Background(), created.ID)
+		assert.Equal(t, map[string]string{
+			links[1]: "file is too large: 3000 bytes, limit is 500",
+			links[2]: "file is too large: more than 500 bytes",
+			links[4]: "file is too large: task would exceed its limit of 1000 bytes",
+			links[5]: "file is too large: task would exceed its limit of 1000 bytes",
+		}, task.FailedLinks)
+		for _, link := range links[1:3] {
+			assert.Len(t, task.Attempts[link], 1, "files too large are not retried")
+		}
+
+		r, err := zip.OpenReader(task.Archive)
+		assert.NoError(t, err)
+		var names []string
+		for _, f := range r.File {
+			names = append(names, f.Name)
+		}
+		r.Close()
+		assert.ElementsMatch(t, []string{"a.pdf", "b.pdf"}, names)
+		log.Sync()
+	}
+}
+
+func TestServiceDiskGuard(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	log := logger.Sugar()
+	defer log.Sync()
+	dir := filepath.Join(t.TempDir(), "archives")
+
+	service := services.NewTaskService(newMockStorage(), log, 3, 3, newMockArchivers(), services.WithDiskGuard(dir, 1<<62))
+	_, err := service.CreateTask(context.Background(), model.TaskOptions{})
+	assert.ErrorIs(t, err, services.ErrLowDiskSpace)
+
+	w := httptest.NewRecorder()
+	router.CreateTask(service, log).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/task", nil))
+	assert.Equal(t, http.StatusInsufficientStorage, w.Code)
+
+	service = services.NewTaskService(newMockStorage(), log, 3, 3, newMockArchivers(), services.WithDiskGuard(dir, 1))
+	_, err = service.CreateTask(context.Background(), model.TaskOptions{})
+	assert.NoError(t, err)
+}
+
+func TestHTTPClient(t *testing.T) {
+	pdf := []byte("%PDF-1.7\n" + strings.Repeat("0", 100))
+	var userAgent atomic.Value
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgent.Store(r.UserAgent())
+		switch r.URL.Path {
+		case "/slow-headers.pdf":
+			time.Sleep(300 * time.Millisecond)
+		case "/stall.pdf":
+			w.Write(pdf[:10])
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+			case <-time.After(2 * time.Second):
+			}
+			return
+		}
+		w.Write(pdf)
+	}))
+	defer srv.Close()
+
+	fetch := func(client *http.Client, url string) error {
+		d := downloader.New(downloader.Config{Client: client})
+		st := &downloader.State{Path: filepath.Join(t.TempDir(), "file")}
+		return d.Resume(context.Background(), url, st)
+	}
+
+	client, err := httpclient.New(httpclient.Config{UserAgent: "file-downloader/test", ResponseHeaderTimeout: 100 * time.Millisecond, IdleReadTimeout: 100 * time.Millisecond})
+	assert.NoError(t, err)
+	assert.NoError(t, fetch(client, srv.URL+"/file.pdf"))
+	assert.Equal(t, "file-downloader/test", userAgent.Load())
+	assert.ErrorContains(t, fetch(client, srv.URL+"/slow-headers.pdf"), "timeout awaiting response headers")
+	started := time.Now()
+	assert.ErrorIs(t, fetch(client, srv.URL+"/stall.pdf"), httpclient.ErrIdleTimeout)
+	assert.Less(t, time.Since(started), time.Second)
+
+	// Requests through a proxy are checked by resolving the target, while
+	// the proxy itself may be on an internal network.
+	var proxied atomic.Value
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied.Store(r.URL.String())
+		w.Write(pdf)
+	}))
+	defer proxy.Close()
+	guard, err := netguard.New(netguard.Config{})
+	assert.NoError(t, err)
+	client, err = httpclient.New(httpclient.Config{Proxy: proxy.URL, Guard: guard})
+	assert.NoError(t, err)
+	assert.NoError(t, fetch(client, "http://93.184.216.34/file.pdf"))
+	assert.Equal(t, "http://93.184.216.34/file.pdf", proxied.Load())
+	assert.ErrorIs(t, fetch(client, "http://10.1.2.3/file.pdf"), netguard.ErrBlocked)
+
+	_, err = httpclient.New(httpclient.Config{Proxy: "ftp://proxy"})
+	assert.Error(t, err)
+	_, err = httpclient.New(httpclient.Config{CertFile: "client.pem"})
+	assert.Error(t, err)
+}
+
+func TestHTTPClientTLS(t *testing.T) {
+	dir := t.TempDir()
+	writePEM := func(name, typ string, der []byte) string {
+		path := filepath.Join(dir, name)
+		assert.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600))
+		return path
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(cryptorand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	clientCert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+	certFile := writePEM("client.pem", "CERTIFICATE", der)
+	keyFile := writePEM("client.key", "EC PRIVATE KEY", keyDER)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("%PDF-1.7\n"))
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	srv.StartTLS()
+	defer srv.Close()
+	caFile := writePEM("ca.pem", "CERTIFICATE", srv.Certificate().Raw)
+
+	fetch := func(cfg httpclient.Config) error {
+		client, err := httpclient.New(cfg)
+		if err != nil {
+			return err
+		}
+		d := downloader.New(downloader.Config{Client: client})
+		return d.Resume(context.Background(), srv.URL+"/file.pdf", &downloader.State{Path: filepath.Join(t.TempDir(), "file")})
+	}
+	assert.ErrorContains(t, fetch(httpclient.Config{}), "certificate")
+	assert.Error(t, fetch(httpclient.Config{CAFile: caFile}), "server asks for a client certificate")
+	assert.NoError(t, fetch(httpclient.Config{CAFile: caFile, CertFile: certFile, KeyFile: keyFile}))
+	assert.Error(t, fetch(httpclient.Config{CAFile: certFile + ".missing"}))
+}
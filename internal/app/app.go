@@ -5,11 +5,13 @@ import (
 	"log"
 	"net/http"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/DeneesK/file-downloader/internal/app/model"
 	"github.com/DeneesK/file-downloader/internal/app/router"
+	"github.com/DeneesK/file-downloader/internal/app/services"
 )
 
 const shutdownTimeout = time.Second * 1
@@ -22,20 +24,32 @@ type Logger interface {
 }
 
 type TaskService interface {
-	CreateTask(ctx context.Context) (string, error)
-	AddLinks(ctx context.Context, taskID string, links []string) error
+	CreateTask(ctx context.Context, opts model.TaskOptions) (*model.Task, error)
+	AddNamedLinks(ctx context.Context, taskID string, links []string, names map[string]string) error
+	SubmitTask(ctx context.Context, taskID string) error
+	CancelTask(ctx context.Context, taskID string) error
 	GetTask(ctx context.Context, taskID string) (*model.Task, error)
+	Events(ctx context.Context, taskID string, lastEventID uint64) (<-chan services.Event, error)
+	OpenArchive(ctx context.Context, taskID string) (*services.Archive, error)
+	ArchiveLink(ctx context.Context, taskID string) (*model.ArchiveLink, error)
+	VerifyArchiveLink(taskID, expires, signature string) error
 	GetNumberActiveTasks() int
 	Start(ctx context.Context)
 }
 
+// Worker is a background subsystem that runs until its context is canceled.
+type Worker interface {
+	Start(ctx context.Context)
+}
+
 type APP struct {
 	srv         *http.Server
 	log         Logger
 	taskService TaskService
+	workers     []Worker
 }
 
-func NewApp(addr string, log Logger, taskService TaskService) *APP {
+func NewApp(addr string, log Logger, taskService TaskService, workers ...Worker) *APP {
 	r := router.NewRouter(taskService, log)
 	s := http.Server{
 		Addr:    addr,
@@ -45,6 +59,7 @@ func NewApp(addr string, log Logger, taskService TaskService) *APP {
 		srv:         &s,
 		log:         log,
 		taskService: taskService,
+		workers:     workers,
 	}
 }
 
@@ -59,7 +74,14 @@ func (a *APP) Run() {
 
 	a.log.Infoln("starting application, server listening on", a.srv.Addr)
 
-	go a.taskService.Start(ctx)
+	var wg sync.WaitGroup
+	for _, w := range append([]Worker{a.taskService}, a.workers...) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.Start(ctx)
+		}()
+	}
 
 	go func() {
 		err := a.srv.ListenAndServe()
@@ -77,5 +99,6 @@ func (a *APP) Run() {
 		log.Fatalf("Error during shutdown: %s", err)
 	}
 	<-shutdownCtx.Done()
+	wg.Wait()
 	a.log.Infoln("application and server gracefully stopped")
 }
@@ -3,58 +3,313 @@ package conf
 import (
 	"flag"
 	"log"
+	"net"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	StorageMemory = "memory"
+	StorageBolt   = "bolt"
 )
 
 type ServerConf struct {
-	MaxLinksPerTask int
-	MaxActiveTasks  int
-	ServerAddr      string
-	Env             string
-	ArchiveDir      string
+	MaxLinksPerTask   int
+	MaxActiveTasks    int
+	ServerAddr        string
+	BaseURL           string
+	SignKey           string
+	PasswordKey       string
+	LinkTTL           time.Duration
+	Env               string
+	ArchiveDir        string
+	DownloadDir       string
+	ArchiveTTL        time.Duration
+	MaxArchiveBytes   int64
+	JanitorInterval   time.Duration
+	OrphanAge         time.Duration
+	StorageType       string
+	DBPath            string
+	RetryMaxAttempts  int
+	RetryBaseDelay    time.Duration
+	RetryMaxDelay     time.Duration
+	RetryJitter       float64
+	RetryableStatuses []int
+	DownloadChunks    int
+	MinChunkSize      int64
+	StreamMode        bool
+	Compression       string
+	CompressionLevel  int
+	Manifest          bool
+	Workers           int
+	LinkWorkers       int
+	ShutdownTimeout   time.Duration
+	ProgressInterval  time.Duration
+	WebhookSecret     string
+	WebhookTimeout    time.Duration
+	WebhookAttempts   int
+	WebhookBaseDelay  time.Duration
+	WebhookMaxDelay   time.Duration
+	AllowedTypes      []string
+	FileTypesPath     string
+	OutboundAllow     []string
+	OutboundDeny      []string
+	MaxFileBytes      int64
+	MaxTaskBytes      int64
+	MinFreeDiskBytes  int64
+	HTTP              HTTPConf
+}
+
+// HTTPConf sets up the client downloads and callbacks are made with.
+type HTTPConf struct {
+	ConnectTimeout      time.Duration
+	TLSTimeout          time.Duration
+	HeaderTimeout       time.Duration
+	IdleReadTimeout     time.Duration
+	Proxy               string
+	CAFile              string
+	ClientCert          string
+	ClientKey           string
+	UserAgent           string
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	MaxConnsPerHost     int
+	IdleConnTimeout     time.Duration
 }
 
 var cfg ServerConf
 
+var retryableStatuses string
+
+var allowedTypes string
+
+var outboundAllow, outboundDeny string
+
 func init() {
 	flag.StringVar(&cfg.ServerAddr, "a", "localhost:8080", "address and port to run server")
+	flag.StringVar(&cfg.BaseURL, "base-url", "", "public URL of the server used in archive links, defaults to http://<address> with localhost for an empty host")
+	flag.StringVar(&cfg.SignKey, "sign-key", "", "secret key for signing archive links, random if empty")
+	flag.StringVar(&cfg.PasswordKey, "password-key", "", "secret key for sealing archive passwords, random if empty")
+	flag.DurationVar(&cfg.LinkTTL, "link-ttl", 24*time.Hour, "how long signed archive links stay valid")
 	flag.StringVar(&cfg.Env, "env", "dev", "environment 'dev' or 'prod'")
 	flag.StringVar(&cfg.ArchiveDir, "dir", "static/archives", "dir for created archives")
+	flag.StringVar(&cfg.DownloadDir, "download-dir", filepath.Join(os.TempDir(), "file-downloader"), "dir for files being downloaded")
+	flag.DurationVar(&cfg.ArchiveTTL, "archive-ttl", 24*time.Hour, "how long archives are kept, 0 keeps them forever")
+	flag.Int64Var(&cfg.MaxArchiveBytes, "max-archive-bytes", 0, "max total size of archives in bytes, 0 means no limit")
+	flag.DurationVar(&cfg.JanitorInterval, "janitor-interval", 10*time.Minute, "how often expired archives and orphaned files are removed")
+	flag.DurationVar(&cfg.OrphanAge, "orphan-age", time.Hour, "min age of an unreferenced temp file before it is removed")
+	flag.StringVar(&cfg.StorageType, "storage", StorageMemory, "task storage 'memory' or 'bolt'")
+	flag.StringVar(&cfg.DBPath, "db", "data/tasks.db", "path to the database file of the 'bolt' storage")
 	flag.IntVar(&cfg.MaxActiveTasks, "tasks", 3, "limit of tasks per user")
 	flag.IntVar(&cfg.MaxLinksPerTask, "links", 3, "limit of links per task")
+	flag.IntVar(&cfg.Workers, "workers", 3, "number of tasks processed concurrently")
+	flag.IntVar(&cfg.LinkWorkers, "link-workers", 3, "number of links downloaded concurrently within a task")
+	flag.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", 30*time.Second, "time to finish in-flight tasks on shutdown")
+	flag.DurationVar(&cfg.ProgressInterval, "progress-interval", 5*time.Second, "how often download progress is saved to the storage")
+	flag.StringVar(&cfg.WebhookSecret, "webhook-secret", "", "secret key for signing task callbacks, callbacks are disabled if empty")
+	flag.DurationVar(&cfg.WebhookTimeout, "webhook-timeout", 10*time.Second, "timeout of a task callback request")
+	flag.IntVar(&cfg.WebhookAttempts, "webhook-attempts", 8, "max delivery attempts per task callback")
+	flag.DurationVar(&cfg.WebhookBaseDelay, "webhook-retry-base", 10*time.Second, "delay before the first callback retry")
+	flag.DurationVar(&cfg.WebhookMaxDelay, "webhook-retry-max", time.Hour, "max delay between callback retries")
+	flag.StringVar(&allowedTypes, "allowed-types", "pdf,jpeg", "comma separated built-in file types allowed for download")
+	flag.StringVar(&cfg.FileTypesPath, "file-types", "", "JSON file with the allowed file types, overrides -allowed-types")
+	flag.StringVar(&outboundAllow, "outbound-allow", "", "comma separated CIDRs and hosts downloads and callbacks may reach in spite of the blocked internal ranges")
+	flag.StringVar(&outboundDeny, "outbound-deny", "", "comma separated CIDRs and hosts downloads and callbacks may never reach")
+	flag.Int64Var(&cfg.MaxFileBytes, "max-file-bytes", 0, "max size of a downloaded file in bytes, 0 means no limit")
+	flag.Int64Var(&cfg.MaxTaskBytes, "max-task-bytes", 0, "max total size of the files of a task in bytes, 0 means no limit")
+	flag.Int64Var(&cfg.MinFreeDiskBytes, "min-free-disk", 512<<20, "min free space in the archive dir in bytes to accept new tasks, 0 disables the check")
+	flag.DurationVar(&cfg.HTTP.ConnectTimeout, "http-connect-timeout", 10*time.Second, "timeout of connecting to a server")
+	flag.DurationVar(&cfg.HTTP.TLSTimeout, "http-tls-timeout", 10*time.Second, "timeout of the TLS handshake")
+	flag.DurationVar(&cfg.HTTP.HeaderTimeout, "http-header-timeout", 30*time.Second, "timeout of waiting for response headers")
+	flag.DurationVar(&cfg.HTTP.IdleReadTimeout, "http-idle-timeout", time.Minute, "max time a response body may deliver no data")
+	flag.StringVar(&cfg.HTTP.Proxy, "http-proxy", "", "proxy URL for outbound requests, HTTP_PROXY and HTTPS_PROXY are used if empty")
+	flag.StringVar(&cfg.HTTP.CAFile, "http-ca-file", "", "PEM bundle of CAs trusted in addition to the system ones")
+	flag.StringVar(&cfg.HTTP.ClientCert, "http-client-cert", "", "PEM client certificate for mTLS")
+	flag.StringVar(&cfg.HTTP.ClientKey, "http-client-key", "", "PEM key of the client certificate")
+	flag.StringVar(&cfg.HTTP.UserAgent, "user-agent", "file-downloader", "User-Agent of outbound requests")
+	flag.IntVar(&cfg.HTTP.MaxIdleConns, "http-max-idle-conns", 100, "max idle connections in total")
+	flag.IntVar(&cfg.HTTP.MaxIdleConnsPerHost, "http-max-idle-conns-per-host", 10, "max idle connections per host")
+	flag.IntVar(&cfg.HTTP.MaxConnsPerHost, "http-max-conns-per-host", 0, "max connections per host, 0 means no limit")
+	flag.DurationVar(&cfg.HTTP.IdleConnTimeout, "http-idle-conn-timeout", 90*time.Second, "how long an idle connection is kept")
+	flag.IntVar(&cfg.RetryMaxAttempts, "retries", 3, "max download attempts per link")
+	flag.DurationVar(&cfg.RetryBaseDelay, "retry-base", 500*time.Millisecond, "delay before the first retry")
+	flag.DurationVar(&cfg.RetryMaxDelay, "retry-max", 30*time.Second, "max delay between retries")
+	flag.Float64Var(&cfg.RetryJitter, "retry-jitter", 0.2, "randomised fraction of the retry delay (0..1)")
+	flag.StringVar(&retryableStatuses, "retry-statuses", "429,502,503,504", "comma separated HTTP statuses to retry")
+	flag.IntVar(&cfg.DownloadChunks, "chunks", 4, "number of parallel byte ranges per file, 1 disables chunking")
+	flag.BoolVar(&cfg.StreamMode, "stream", false, "pipe downloads straight into the archive without temp files")
+	flag.StringVar(&cfg.Compression, "compression", "auto", "zip entries compression: store, deflate or auto")
+	flag.BoolVar(&cfg.Manifest, "manifest", false, "add manifest.json and SHA256SUMS to archives")
+	flag.IntVar(&cfg.CompressionLevel, "compression-level", 0, "compression level 1-9, 0 means the compressor default")
+	flag.Int64Var(&cfg.MinChunkSize, "min-chunk", 8<<20, "minimal size of a byte range in bytes")
 }
 
 func MustLoad() *ServerConf {
 	flag.Parse()
 
-	if serverAddr, ok := os.LookupEnv("SERVER_ADDRESS"); ok {
-		cfg.ServerAddr = serverAddr
+	lookupString("SERVER_ADDRESS", &cfg.ServerAddr)
+	lookupString("BASE_URL", &cfg.BaseURL)
+	lookupString("SIGN_KEY", &cfg.SignKey)
+	lookupString("PASSWORD_KEY", &cfg.PasswordKey)
+	lookupDuration("LINK_TTL", &cfg.LinkTTL)
+	lookupString("ENV", &cfg.Env)
+	lookupString("ARCHIVE_DIR", &cfg.ArchiveDir)
+	lookupString("DOWNLOAD_DIR", &cfg.DownloadDir)
+	lookupDuration("ARCHIVE_TTL", &cfg.ArchiveTTL)
+	lookupInt64("MAX_ARCHIVE_BYTES", &cfg.MaxArchiveBytes)
+	lookupDuration("JANITOR_INTERVAL", &cfg.JanitorInterval)
+	lookupDuration("ORPHAN_AGE", &cfg.OrphanAge)
+	lookupString("STORAGE_TYPE", &cfg.StorageType)
+	lookupString("DB_PATH", &cfg.DBPath)
+	lookupInt("MAX_ACTIVE_TASKS", &cfg.MaxActiveTasks)
+	lookupInt("MAX_LINKS_PER_TASK", &cfg.MaxLinksPerTask)
+	lookupInt("WORKERS", &cfg.Workers)
+	lookupInt("LINK_WORKERS", &cfg.LinkWorkers)
+	lookupDuration("SHUTDOWN_TIMEOUT", &cfg.ShutdownTimeout)
+	lookupDuration("PROGRESS_INTERVAL", &cfg.ProgressInterval)
+	lookupString("WEBHOOK_SECRET", &cfg.WebhookSecret)
+	lookupDuration("WEBHOOK_TIMEOUT", &cfg.WebhookTimeout)
+	lookupInt("WEBHOOK_MAX_ATTEMPTS", &cfg.WebhookAttempts)
+	lookupDuration("WEBHOOK_RETRY_BASE_DELAY", &cfg.WebhookBaseDelay)
+	lookupDuration("WEBHOOK_RETRY_MAX_DELAY", &cfg.WebhookMaxDelay)
+	lookupString("ALLOWED_TYPES", &allowedTypes)
+	lookupString("FILE_TYPES_FILE", &cfg.FileTypesPath)
+	lookupString("OUTBOUND_ALLOW", &outboundAllow)
+	lookupString("OUTBOUND_DENY", &outboundDeny)
+	lookupInt64("MAX_FILE_BYTES", &cfg.MaxFileBytes)
+	lookupInt64("MAX_TASK_BYTES", &cfg.MaxTaskBytes)
+	lookupInt64("MIN_FREE_DISK_BYTES", &cfg.MinFreeDiskBytes)
+	lookupDuration("HTTP_CONNECT_TIMEOUT", &cfg.HTTP.ConnectTimeout)
+	lookupDuration("HTTP_TLS_TIMEOUT", &cfg.HTTP.TLSTimeout)
+	lookupDuration("HTTP_HEADER_TIMEOUT", &cfg.HTTP.HeaderTimeout)
+	lookupDuration("HTTP_IDLE_TIMEOUT", &cfg.HTTP.IdleReadTimeout)
+	lookupString("HTTP_PROXY_URL", &cfg.HTTP.Proxy)
+	lookupString("HTTP_CA_FILE", &cfg.HTTP.CAFile)
+	lookupString("HTTP_CLIENT_CERT", &cfg.HTTP.ClientCert)
+	lookupString("HTTP_CLIENT_KEY", &cfg.HTTP.ClientKey)
+	lookupString("USER_AGENT", &cfg.HTTP.UserAgent)
+	lookupInt("HTTP_MAX_IDLE_CONNS", &cfg.HTTP.MaxIdleConns)
+	lookupInt("HTTP_MAX_IDLE_CONNS_PER_HOST", &cfg.HTTP.MaxIdleConnsPerHost)
+	lookupInt("HTTP_MAX_CONNS_PER_HOST", &cfg.HTTP.MaxConnsPerHost)
+	lookupDuration("HTTP_IDLE_CONN_TIMEOUT", &cfg.HTTP.IdleConnTimeout)
+	lookupInt("RETRY_MAX_ATTEMPTS", &cfg.RetryMaxAttempts)
+	lookupDuration("RETRY_BASE_DELAY", &cfg.RetryBaseDelay)
+	lookupDuration("RETRY_MAX_DELAY", &cfg.RetryMaxDelay)
+	lookupFloat("RETRY_JITTER", &cfg.RetryJitter)
+	lookupString("RETRY_STATUSES", &retryableStatuses)
+	lookupInt("DOWNLOAD_CHUNKS", &cfg.DownloadChunks)
+	lookupInt64("MIN_CHUNK_SIZE", &cfg.MinChunkSize)
+	lookupBool("STREAM_MODE", &cfg.StreamMode)
+	lookupString("COMPRESSION", &cfg.Compression)
+	lookupInt("COMPRESSION_LEVEL", &cfg.CompressionLevel)
+	lookupBool("MANIFEST", &cfg.Manifest)
+
+	cfg.RetryableStatuses = mustParseInts(retryableStatuses)
+	cfg.AllowedTypes = parseList(allowedTypes)
+	cfg.OutboundAllow = parseList(outboundAllow)
+	cfg.OutboundDeny = parseList(outboundDeny)
+	if cfg.BaseURL == "" {
+		cfg.BaseURL = defaultBaseURL(cfg.ServerAddr)
 	}
 
-	if env, ok := os.LookupEnv("ENV"); ok {
-		cfg.Env = env
+	return &cfg
+}
+
+// defaultBaseURL returns the URL of the server listening on addr. An address
+// without a host or with an unspecified one listens on all interfaces, so
+// localhost is used instead.
+func defaultBaseURL(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "http://" + addr
 	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "localhost"
+	}
+	return "http://" + net.JoinHostPort(host, port)
+}
 
-	if archiveDir, ok := os.LookupEnv("ARCHIVE_DIR"); ok {
-		cfg.ArchiveDir = archiveDir
+func lookupString(key string, dst *string) {
+	if v, ok := os.LookupEnv(key); ok {
+		*dst = v
 	}
+}
 
-	if maxActiveTasks, ok := os.LookupEnv("MAX_ACTIVE_TASKS"); ok {
-		r, err := strconv.Atoi(maxActiveTasks)
+func lookupInt(key string, dst *int) {
+	if v, ok := os.LookupEnv(key); ok {
+		r, err := strconv.Atoi(v)
 		if err != nil {
 			log.Fatalf("failed to parse config: %s", err)
 		}
-		cfg.MaxActiveTasks = r
+		*dst = r
 	}
+}
 
-	if maxLinksPerTask, ok := os.LookupEnv("MAX_ACTIVE_TASKS"); ok {
-		r, err := strconv.Atoi(maxLinksPerTask)
+func lookupBool(key string, dst *bool) {
+	if v, ok := os.LookupEnv(key); ok {
+		r, err := strconv.ParseBool(v)
 		if err != nil {
 			log.Fatalf("failed to parse config: %s", err)
 		}
-		cfg.MaxLinksPerTask = r
+		*dst = r
 	}
+}
 
-	return &cfg
+func lookupInt64(key string, dst *int64) {
+	if v, ok := os.LookupEnv(key); ok {
+		r, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			log.Fatalf("failed to parse config: %s", err)
+		}
+		*dst = r
+	}
+}
+
+func lookupFloat(key string, dst *float64) {
+	if v, ok := os.LookupEnv(key); ok {
+		r, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			log.Fatalf("failed to parse config: %s", err)
+		}
+		*dst = r
+	}
+}
+
+func lookupDuration(key string, dst *time.Duration) {
+	if v, ok := os.LookupEnv(key); ok {
+		r, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("failed to parse config: %s", err)
+		}
+		*dst = r
+	}
+}
+
+func mustParseInts(s string) []int {
+	var res []int
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		r, err := strconv.Atoi(part)
+		if err != nil {
+			log.Fatalf("failed to parse config: %s", err)
+		}
+		res = append(res, r)
+	}
+	return res
+}
+
+func parseList(s string) []string {
+	var res []string
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			res = append(res, part)
+		}
+	}
+	return res
 }
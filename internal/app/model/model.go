@@ -1,18 +1,216 @@
 package model
 
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	StatusCreated    string = "created"
+	StatusCollecting string = "collecting"
+	StatusQueued     string = "queued"
+	StatusRunning    string = "running"
+	StatusArchiving  string = "archiving"
+	StatusDone       string = "done"
+	StatusFailed     string = "failed"
+	StatusCanceled   string = "canceled"
+	StatusExpired    string = "expired"
+)
+
 const (
-	StatusCreated string = "created"
-	StatusRunning string = "running"
-	StatusDone    string = "done"
-	StatusFailed  string = "failed"
+	DeliveryPending   string = "pending"
+	DeliveryDelivered string = "delivered"
+	DeliveryFailed    string = "failed"
 )
 
+var ErrInvalidTransition = errors.New("invalid task status transition")
+
+// transitions lists the statuses a task may move to from each status.
+// A running or archiving task goes back to queued when it is interrupted by
+// a shutdown or a crash.
+var transitions = map[string][]string{
+	StatusCreated:    {StatusCollecting, StatusCanceled},
+	StatusCollecting: {StatusQueued, StatusCanceled},
+	StatusQueued:     {StatusRunning, StatusCanceled},
+	StatusRunning:    {StatusArchiving, StatusFailed, StatusQueued, StatusCanceled},
+	StatusArchiving:  {StatusDone, StatusFailed, StatusQueued, StatusCanceled},
+	StatusDone:       {StatusExpired},
+}
+
 type Task struct {
-	ID              string            `json:"task_id"`
-	Status          string            `json:"status"`
-	Archive         string            `json:"archive,omitempty"`
-	Links           []string          `json:"-"`
-	LinksNumber     int               `json:"-"`
-	DownloadedFiles []string          `json:"-"`
-	FailedLinks     map[string]string `json:"failed_files,omitempty"`
+	ID     string `json:"task_id"`
+	Status string `json:"status"`
+	TaskOptions
+	Archive          string               `json:"-"`
+	ArchiveURL       string               `json:"archive,omitempty"`
+	ArchiveExpiresAt *time.Time           `json:"archive_expires_at,omitempty"`
+	ExpiredReason    string               `json:"expired_reason,omitempty"`
+	LastAccessAt     time.Time            `json:"-"`
+	SealedPassword   []byte               `json:"-"`
+	Links            []string             `json:"-"`
+	Names            map[string]string    `json:"-"`
+	LinksNumber      int                  `json:"-"`
+	DownloadedFiles  []string             `json:"-"`
+	FailedLinks      map[string]string    `json:"failed_files,omitempty"`
+	Downloads        map[string]*Download `json:"-"`
+	Attempts         map[string][]Attempt `json:"attempts,omitempty"`
+	Progress         *TaskProgress        `json:"progress,omitempty"`
+	Callback         *Delivery            `json:"callback,omitempty"`
+}
+
+// TaskOptions are the settings a client may choose when creating a task.
+type TaskOptions struct {
+	Format           string `json:"format,omitempty"`
+	Compression      string `json:"compression,omitempty"`
+	CompressionLevel int    `json:"compression_level,omitempty"`
+	Encrypt          bool   `json:"encrypt,omitempty"`
+	// Password is only set on the way in and in the reply to creation when
+	// it was generated; tasks keep it sealed in SealedPassword.
+	Password string `json:"password,omitempty"`
+	// Manifest adds manifest.json and SHA256SUMS to the archive; nil means
+	// the server default.
+	Manifest *bool `json:"manifest,omitempty"`
+	// CallbackURL is POSTed the task when it is done, failed or canceled.
+	CallbackURL string `json:"callback_url,omitempty"`
+}
+
+// Delivery tracks the callback of a finished task. The task keeps it until
+// the callback is delivered or runs out of attempts, so that pending
+// deliveries survive a restart.
+type Delivery struct {
+	Status        string     `json:"status"`
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"`
+	Attempts      []Attempt  `json:"attempts,omitempty"`
+}
+
+// ArchiveLink is a signed link to the archive that stops working at ExpiresAt.
+type ArchiveLink struct {
+	URL       string    `json:"archive"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Progress is how far a download has got. Total is zero while the size is
+// unknown; Throughput is in bytes per second and ETA in seconds.
+type Progress struct {
+	Received   int64   `json:"received"`
+	Total      int64   `json:"total,omitempty"`
+	Percent    float64 `json:"percent,omitempty"`
+	Throughput float64 `json:"throughput"`
+	ETA        int64   `json:"eta_seconds,omitempty"`
+	Done       bool    `json:"done,omitempty"`
+}
+
+// TaskProgress sums up the progress of the links of a task.
+type TaskProgress struct {
+	Progress
+	Links     map[string]Progress `json:"links"`
+	UpdatedAt time.Time           `json:"updated_at"`
+}
+
+// Attempt is the outcome of one try to download a link or deliver a
+// callback.
+type Attempt struct {
+	Number     int       `json:"number"`
+	StartedAt  time.Time `json:"started_at"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+func CanTransition(from, to string) bool {
+	for _, status := range transitions[from] {
+		if status == to {
+			return true
+		}
+	}
+	return false
+}
+
+// IsTerminal reports whether the task has finished processing.
+func (t *Task) IsTerminal() bool {
+	switch t.Status {
+	case StatusDone, StatusFailed, StatusCanceled, StatusExpired:
+		return true
+	}
+	return false
+}
+
+// SetStatus moves the task to status if the transition is allowed. A task
+// that gets terminal won't be archived again, so it drops its sealed
+// password; one with a callback URL that gets done, failed or canceled is
+// due a callback.
+func (t *Task) SetStatus(status string) error {
+	if !CanTransition(t.Status, status) {
+		return fmt.Errorf("%w: %s -> %s", ErrInvalidTransition, t.Status, status)
+	}
+	t.Status = status
+	if t.IsTerminal() {
+		t.SealedPassword = nil
+	}
+	if t.CallbackURL != "" && t.Callback == nil && t.IsTerminal() && status != StatusExpired {
+		now := time.Now()
+		t.Callback = &Delivery{Status: DeliveryPending, NextAttemptAt: &now}
+	}
+	return nil
+}
+
+// Download keeps the progress of a single link so that it can be resumed
+// from Offset after a retry or a restart.
+type Download struct {
+	Path         string
+	Offset       int64
+	Size         int64
+	ETag         string
+	LastModified string
+	Done         bool
+
+	// Entry and the fields below describe a finished download for the
+	// archive manifest.
+	Entry        string
+	ContentType  string
+	SHA256       string
+	StatusCode   int
+	DownloadedAt time.Time
+}
+
+// Clone returns a deep copy of the task, so that storages can hand out
+// tasks without sharing maps and slices with the task being processed.
+func (t Task) Clone() Task {
+	c := t
+	c.Links = append([]string(nil), t.Links...)
+	c.SealedPassword = append([]byte(nil), t.SealedPassword...)
+	c.DownloadedFiles = append([]string(nil), t.DownloadedFiles...)
+	if t.Names != nil {
+		c.Names = make(map[string]string, len(t.Names))
+		for k, v := range t.Names {
+			c.Names[k] = v
+		}
+	}
+	c.FailedLinks = make(map[string]string, len(t.FailedLinks))
+	for k, v := range t.FailedLinks {
+		c.FailedLinks[k] = v
+	}
+	c.Downloads = make(map[string]*Download, len(t.Downloads))
+	for k, v := range t.Downloads {
+		d := *v
+		c.Downloads[k] = &d
+	}
+	if t.Progress != nil {
+		p := *t.Progress
+		p.Links = make(map[string]Progress, len(t.Progress.Links))
+		for k, v := range t.Progress.Links {
+			p.Links[k] = v
+		}
+		c.Progress = &p
+	}
+	if t.Callback != nil {
+		cb := *t.Callback
+		cb.Attempts = append([]Attempt(nil), t.Callback.Attempts...)
+		c.Callback = &cb
+	}
+	c.Attempts = make(map[string][]Attempt, len(t.Attempts))
+	for k, v := range t.Attempts {
+		c.Attempts[k] = append([]Attempt(nil), v...)
+	}
+	return c
 }
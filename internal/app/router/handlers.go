@@ -4,7 +4,12 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"mime"
 	"net/http"
+	"os"
+	"strconv"
+	"time"
 
 	"github.com/DeneesK/file-downloader/internal/app/model"
 	"github.com/DeneesK/file-downloader/internal/app/services"
@@ -14,22 +19,47 @@ import (
 
 type Links struct {
 	Links []string `json:"links"`
+	// Names sets the names of archive entries by link.
+	Names  map[string]string `json:"names"`
+	Submit bool              `json:"submit"`
+}
+
+// RejectedLinks is the body of the response to links that can't be added,
+// with the reason by link.
+type RejectedLinks struct {
+	Error string            `json:"error"`
+	Links map[string]string `json:"links"`
 }
 
 func CreateTask(taskService TaskService, log Logger) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
-		id, err := taskService.CreateTask(ctx)
+
+		opts := model.TaskOptions{}
+		if err := json.NewDecoder(r.Body).Decode(&opts); err != nil && err != io.EOF {
+			http.Error(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+		if format := r.URL.Query().Get("format"); format != "" {
+			opts.Format = format
+		}
+
+		task, err := taskService.CreateTask(ctx, opts)
 		if err == services.ErrTooManyTasks {
 			http.Error(w, err.Error(), http.StatusTooManyRequests)
 			return
+		} else if errors.Is(err, services.ErrLowDiskSpace) {
+			http.Error(w, err.Error(), http.StatusInsufficientStorage)
+			return
+		} else if errors.Is(err, services.ErrUnknownFormat) || errors.Is(err, services.ErrUnknownCompression) || errors.Is(err, services.ErrBadCompressionLevel) || errors.Is(err, services.ErrEncryptionUnsupported) || errors.Is(err, services.ErrBadCallbackURL) || errors.Is(err, services.ErrCallbacksDisabled) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		} else if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
 		w.WriteHeader(http.StatusCreated)
-		task := model.Task{ID: id, Status: model.StatusCreated}
 
 		err = json.NewEncoder(w).Encode(task)
 		if err != nil {
@@ -53,10 +83,22 @@ func AddLinks(taskService TaskService, log Logger) http.HandlerFunc {
 			return
 		}
 
-		err := taskService.AddLinks(ctx, id, links.Links)
-		if errors.Is(err, services.ErrNotValidExaction) || errors.Is(err, services.ErrTooManyFiles) {
+		err := taskService.AddNamedLinks(ctx, id, links.Links, links.Names)
+		if err == nil && links.Submit {
+			err = taskService.SubmitTask(ctx, id)
+		}
+		var rejected *services.RejectedLinksError
+		if errors.As(err, &rejected) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(RejectedLinks{Error: services.ErrNotValidExaction.Error(), Links: rejected.Links})
+			return
+		} else if errors.Is(err, services.ErrNotValidExaction) || errors.Is(err, services.ErrTooManyFiles) || errors.Is(err, services.ErrNoLinks) || errors.Is(err, services.ErrBadEntryName) {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
+		} else if errors.Is(err, services.ErrTaskFrozen) || errors.Is(err, model.ErrInvalidTransition) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
 		} else if err == storage.ErrNotFound {
 			http.Error(w, err.Error(), http.StatusNotFound)
 			return
@@ -69,6 +111,40 @@ func AddLinks(taskService TaskService, log Logger) http.HandlerFunc {
 	}
 }
 
+func SubmitTask(taskService TaskService, log Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		id := chi.URLParam(r, "id")
+
+		err := taskService.SubmitTask(ctx, id)
+		if errors.Is(err, services.ErrNoLinks) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if errors.Is(err, model.ErrInvalidTransition) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if err == storage.ErrNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		task := model.Task{ID: id, Status: model.StatusQueued}
+
+		err = json.NewEncoder(w).Encode(task)
+		if err != nil {
+			errorString := fmt.Sprintf("failed to encode task to json: %s", err.Error())
+			log.Error(errorString)
+			http.Error(w, errorString, http.StatusBadRequest)
+			return
+		}
+	}
+}
+
 func GetTask(taskService TaskService, log Logger) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
@@ -93,3 +169,151 @@ func GetTask(taskService TaskService, log Logger) http.HandlerFunc {
 		}
 	}
 }
+
+// keepAliveInterval is how often a comment is sent on an idle event stream,
+// so that proxies don't close it.
+const keepAliveInterval = 15 * time.Second
+
+// TaskEvents streams the events of the task as Server-Sent Events. A client
+// that reconnects with Last-Event-ID gets the events it missed.
+func TaskEvents(taskService TaskService, log Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		id := chi.URLParam(r, "id")
+
+		lastEventID, _ := strconv.ParseUint(r.Header.Get("Last-Event-ID"), 10, 64)
+		events, err := taskService.Events(ctx, id, lastEventID)
+		if err == storage.ErrNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		rc := http.NewResponseController(w)
+		if err := rc.Flush(); err != nil {
+			log.Errorf("event stream of task ID %s can't be flushed: %s", id, err)
+			return
+		}
+
+		keepAlive := time.NewTicker(keepAliveInterval)
+		defer keepAlive.Stop()
+		for {
+			select {
+			case ev, ok := <-events:
+				if !ok {
+					return
+				}
+				fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.ID, ev.Type, ev.Data)
+			case <-keepAlive.C:
+				io.WriteString(w, ": keep-alive\n\n")
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func CancelTask(taskService TaskService, log Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		id := chi.URLParam(r, "id")
+
+		err := taskService.CancelTask(ctx, id)
+		if errors.Is(err, model.ErrInvalidTransition) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if err == storage.ErrNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		task, err := taskService.GetTask(ctx, id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		err = json.NewEncoder(w).Encode(task)
+		if err != nil {
+			errorString := fmt.Sprintf("failed to encode task to json: %s", err.Error())
+			log.Error(errorString)
+			http.Error(w, errorString, http.StatusBadRequest)
+			return
+		}
+	}
+}
+
+func GetArchive(taskService TaskService, log Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		id := chi.URLParam(r, "id")
+
+		query := r.URL.Query()
+		err := taskService.VerifyArchiveLink(id, query.Get("expires"), query.Get("signature"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+
+		archive, err := taskService.OpenArchive(ctx, id)
+		if err == storage.ErrNotFound || errors.Is(err, os.ErrNotExist) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		} else if errors.Is(err, services.ErrArchiveExpired) {
+			http.Error(w, err.Error(), http.StatusGone)
+			return
+		} else if errors.Is(err, services.ErrArchiveNotReady) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer archive.Content.Close()
+
+		w.Header().Set("Content-Type", archive.ContentType)
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": archive.Name}))
+		w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, archive.ModTime.UnixNano(), archive.Size))
+		http.ServeContent(w, r, archive.Name, archive.ModTime, archive.Content)
+	}
+}
+
+func CreateArchiveLink(taskService TaskService, log Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		id := chi.URLParam(r, "id")
+
+		link, err := taskService.ArchiveLink(ctx, id)
+		if err == storage.ErrNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		} else if errors.Is(err, services.ErrArchiveNotReady) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		err = json.NewEncoder(w).Encode(link)
+		if err != nil {
+			errorString := fmt.Sprintf("failed to encode link to json: %s", err.Error())
+			log.Error(errorString)
+			http.Error(w, errorString, http.StatusBadRequest)
+			return
+		}
+	}
+}
@@ -34,6 +34,12 @@ func (r *loggingResponseWriter) WriteHeader(statusCode int) {
 	r.responseData.status = statusCode
 }
 
+// Unwrap lets http.ResponseController reach the Flusher of the underlying
+// writer.
+func (r *loggingResponseWriter) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
 func NewLoggingMiddleware(log Logger) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 
@@ -5,13 +5,20 @@ import (
 
 	"github.com/DeneesK/file-downloader/internal/app/model"
 	"github.com/DeneesK/file-downloader/internal/app/router/middlewares"
+	"github.com/DeneesK/file-downloader/internal/app/services"
 	"github.com/go-chi/chi/v5"
 )
 
 type TaskService interface {
-	CreateTask(ctx context.Context) (string, error)
-	AddLinks(ctx context.Context, taskID string, links []string) error
+	CreateTask(ctx context.Context, opts model.TaskOptions) (*model.Task, error)
+	AddNamedLinks(ctx context.Context, taskID string, links []string, names map[string]string) error
+	SubmitTask(ctx context.Context, taskID string) error
+	CancelTask(ctx context.Context, taskID string) error
 	GetTask(ctx context.Context, taskID string) (*model.Task, error)
+	Events(ctx context.Context, taskID string, lastEventID uint64) (<-chan services.Event, error)
+	OpenArchive(ctx context.Context, taskID string) (*services.Archive, error)
+	ArchiveLink(ctx context.Context, taskID string) (*model.ArchiveLink, error)
+	VerifyArchiveLink(taskID, expires, signature string) error
 	GetNumberActiveTasks() int
 }
 
@@ -28,6 +35,12 @@ func NewRouter(taskService TaskService, log Logger) *chi.Mux {
 	r.Use(loggingMiddleware)
 	r.Post("/task", CreateTask(taskService, log))
 	r.Patch("/task/{id}", AddLinks(taskService, log))
+	r.Post("/task/{id}/submit", SubmitTask(taskService, log))
+	r.Post("/task/{id}/cancel", CancelTask(taskService, log))
+	r.Delete("/task/{id}", CancelTask(taskService, log))
 	r.Get("/task/{id}", GetTask(taskService, log))
+	r.Get("/task/{id}/events", TaskEvents(taskService, log))
+	r.Get("/task/{id}/archive", GetArchive(taskService, log))
+	r.Post("/task/{id}/link", CreateArchiveLink(taskService, log))
 	return r
 }
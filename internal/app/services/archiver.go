@@ -2,15 +2,207 @@ package services
 
 import (
 	"archive/zip"
+	"compress/flate"
+	"errors"
+	"fmt"
 	"io"
+	"mime"
+	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
 )
 
 const filePerm = 0755
 
+var ErrUnknownFormat = errors.New("unknown archive format")
+var ErrUnknownCompression = errors.New("unknown compression method")
+var ErrBadCompressionLevel = errors.New("compression level must be between 1 and 9")
+
+const (
+	CompressionAuto    = "auto"
+	CompressionStore   = "store"
+	CompressionDeflate = "deflate"
+)
+
+// ArchiveOptions tune how an archive is written. Compression picks the
+// method of ZIP entries: store, deflate, or auto, which stores entries that
+// are compressed already. Level applies to deflate, gzip and zstd; zero means
+// the default level of the compressor.
+type ArchiveOptions struct {
+	Compression string
+	Level       int
+	// Password turns on WinZip AES-256 encryption of ZIP entries.
+	Password string
+}
+
+func (o ArchiveOptions) Validate() error {
+	switch o.Compression {
+	case "", CompressionAuto, CompressionStore, CompressionDeflate:
+	default:
+		return fmt.Errorf("%w %q, supported: %s, %s, %s", ErrUnknownCompression, o.Compression, CompressionAuto, CompressionStore, CompressionDeflate)
+	}
+	if o.Level < 0 || o.Level > 9 {
+		return ErrBadCompressionLevel
+	}
+	return nil
+}
+
+// compressedTypes are MIME types whose content gains next to nothing from
+// being compressed again.
+var compressedTypes = map[string]struct{}{
+	"application/pdf":              {},
+	"application/zip":              {},
+	"application/gzip":             {},
+	"application/zstd":             {},
+	"application/x-7z-compressed":  {},
+	"application/x-rar-compressed": {},
+	"application/x-bzip2":          {},
+	"application/x-xz":             {},
+	"image/jpeg":                   {},
+	"image/png":                    {},
+	"image/gif":                    {},
+	"image/webp":                   {},
+	"image/avif":                   {},
+}
+
+func isCompressedType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if strings.HasPrefix(mediaType, "video/") || strings.HasPrefix(mediaType, "audio/") {
+		return true
+	}
+	_, ok := compressedTypes[mediaType]
+	return ok
+}
+
+// zipHeader returns the header of an entry holding content of contentType.
+func (o ArchiveOptions) zipHeader(name, contentType string) *zip.FileHeader {
+	method := zip.Deflate
+	switch o.Compression {
+	case CompressionStore:
+		method = zip.Store
+	case CompressionAuto:
+		if isCompressedType(contentType) {
+			method = zip.Store
+		}
+	}
+	return &zip.FileHeader{Name: name, Method: method, Modified: time.Now()}
+}
+
+// createEntry adds an entry to zw, encrypted if a password is set. The entry
+// must be closed before the next one is created.
+func (o ArchiveOptions) createEntry(zw *zip.Writer, name, contentType string) (io.WriteCloser, error) {
+	fh := o.zipHeader(name, contentType)
+	if o.Password != "" {
+		return createAESEntry(zw, fh, o.Password, o.Level)
+	}
+	w, err := zw.CreateHeader(fh)
+	if err != nil {
+		return nil, err
+	}
+	return nopWriteCloser{w}, nil
+}
+
+func (o ArchiveOptions) newZipWriter(w io.Writer) *zip.Writer {
+	zw := zip.NewWriter(w)
+	if o.Level > 0 {
+		zw.RegisterCompressor(zip.Deflate, func(w io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(w, o.Level)
+		})
+	}
+	return zw
+}
+
+// fileContentType guesses the content type of a file by its extension or,
+// failing that, by its first bytes.
+func fileContentType(f *os.File) string {
+	if contentType := mime.TypeByExtension(filepath.Ext(f.Name())); contentType != "" {
+		return contentType
+	}
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	f.Seek(0, io.SeekStart)
+	return http.DetectContentType(head[:n])
+}
+
+// Format describes an archive format a client can ask for.
+type Format struct {
+	Name        string
+	Ext         string
+	ContentType string
+}
+
+var (
+	FormatZip    = Format{Name: "zip", Ext: ".zip", ContentType: "application/zip"}
+	FormatTar    = Format{Name: "tar", Ext: ".tar", ContentType: "application/x-tar"}
+	FormatTarGz  = Format{Name: "tar.gz", Ext: ".tar.gz", ContentType: "application/gzip"}
+	FormatTarZst = Format{Name: "tar.zst", Ext: ".tar.zst", ContentType: "application/zstd"}
+)
+
+type archiverEntry struct {
+	format   Format
+	archiver Archiver
+}
+
+// Archivers is a registry of archivers by format name. The first registered
+// format is used for tasks that don't ask for one.
+type Archivers struct {
+	def     string
+	entries map[string]archiverEntry
+}
+
+func NewArchivers() *Archivers {
+	return &Archivers{entries: make(map[string]archiverEntry)}
+}
+
+// NewArchiverRegistry returns the registry of all built-in formats writing
+// to archiveDir, with ZIP as the default.
+func NewArchiverRegistry(archiveDir string) *Archivers {
+	r := NewArchivers()
+	r.Register(FormatZip, NewZipService(archiveDir))
+	r.Register(FormatTar, NewTarService(archiveDir, FormatTar))
+	r.Register(FormatTarGz, NewTarService(archiveDir, FormatTarGz))
+	r.Register(FormatTarZst, NewTarService(archiveDir, FormatTarZst))
+	return r
+}
+
+func (r *Archivers) Register(format Format, archiver Archiver) {
+	if r.def == "" {
+		r.def = format.Name
+	}
+	r.entries[format.Name] = archiverEntry{format: format, archiver: archiver}
+}
+
+// Get returns the archiver for the format name, the default one if name is
+// empty.
+func (r *Archivers) Get(name string) (Format, Archiver, error) {
+	if name == "" {
+		name = r.def
+	}
+	e, ok := r.entries[name]
+	if !ok {
+		return Format{}, nil, fmt.Errorf("%w %q, supported: %s", ErrUnknownFormat, name, strings.Join(r.Names(), ", "))
+	}
+	return e.format, e.archiver, nil
+}
+
+// Names lists the registered format names.
+func (r *Archivers) Names() []string {
+	names := make([]string, 0, len(r.entries))
+	for name := range r.entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 type zipService struct {
 	archiveDir string
 }
@@ -20,30 +212,170 @@ func NewZipService(archiveDir string) *zipService {
 	return &zipService{archiveDir: archiveDir}
 }
 
-func (s *zipService) CreateZipArchive(files []string) (string, error) {
+// CreateArchive packs the files that can be opened. A failed write fails
+// the whole archive, which is removed then.
+func (s *zipService) CreateArchive(files []ArchiveFile, opts ArchiveOptions) (archive string, err error) {
 	archiveName := filepath.Join(s.archiveDir, uuid.NewString()+".zip")
 	out, err := os.Create(archiveName)
 	if err != nil {
 		return "", err
 	}
-	defer out.Close()
-
-	zipWriter := zip.NewWriter(out)
-	defer zipWriter.Close()
+	defer func() {
+		if err != nil {
+			out.Close()
+			os.Remove(archiveName)
+		}
+	}()
 
+	zipWriter := opts.newZipWriter(out)
 	for _, file := range files {
-		f, err := os.Open(file)
+		f, err := os.Open(file.Path)
 		if err != nil {
 			continue
 		}
-		defer f.Close()
-
-		w, err := zipWriter.Create(filepath.Base(file))
+		err = addZipEntry(zipWriter, file.Name, f, opts)
+		f.Close()
 		if err != nil {
-			continue
+			return "", err
 		}
-		io.Copy(w, f)
 	}
-
+	if err := zipWriter.Close(); err != nil {
+		return "", err
+	}
+	if err := out.Close(); err != nil {
+		return "", err
+	}
 	return archiveName, nil
 }
+
+func addZipEntry(zw *zip.Writer, name string, f *os.File, opts ArchiveOptions) error {
+	w, err := opts.createEntry(zw, name, fileContentType(f))
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, f); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// NewStream starts an archive whose entries are written as the data
+// arrives, without intermediate files.
+func (s *zipService) NewStream(opts ArchiveOptions) (ArchiveStream, error) {
+	archiveName := filepath.Join(s.archiveDir, uuid.NewString()+".zip")
+	out, err := os.Create(archiveName)
+	if err != nil {
+		return nil, err
+	}
+	return &zipStream{
+		path:   archiveName,
+		out:    out,
+		w:      opts.newZipWriter(out),
+		opts:   opts,
+		broken: make(map[int]struct{}),
+	}, nil
+}
+
+type zipStream struct {
+	path    string
+	out     *os.File
+	w       *zip.Writer
+	opts    ArchiveOptions
+	entry   io.WriteCloser
+	entries int
+	broken  map[int]struct{}
+}
+
+func (z *zipStream) Create(name string) (io.Writer, error) {
+	if err := z.closeEntry(); err != nil {
+		return nil, err
+	}
+	w, err := z.opts.createEntry(z.w, name, mime.TypeByExtension(filepath.Ext(name)))
+	if err != nil {
+		return nil, err
+	}
+	z.entry = w
+	z.entries++
+	return w, nil
+}
+
+func (z *zipStream) closeEntry() error {
+	if z.entry == nil {
+		return nil
+	}
+	err := z.entry.Close()
+	z.entry = nil
+	return err
+}
+
+// Discard marks the last created entry as broken. A zip entry can't be taken
+// back once its data is written, so broken entries are dropped by Close.
+func (z *zipStream) Discard() {
+	if z.entries > 0 {
+		z.broken[z.entries-1] = struct{}{}
+	}
+}
+
+func (z *zipStream) Close() (string, error) {
+	err := z.closeEntry()
+	if cErr := z.w.Close(); err == nil {
+		err = cErr
+	}
+	if cErr := z.out.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		os.Remove(z.path)
+		return "", err
+	}
+	if len(z.broken) > 0 {
+		if err := z.compact(); err != nil {
+			os.Remove(z.path)
+			return "", err
+		}
+	}
+	return z.path, nil
+}
+
+// Abort drops the archive altogether.
+func (z *zipStream) Abort() {
+	z.w.Close()
+	z.out.Close()
+	os.Remove(z.path)
+}
+
+// compact rewrites the archive without the broken entries. Entries are copied
+// as is, without being decompressed.
+func (z *zipStream) compact() error {
+	r, err := zip.OpenReader(z.path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	tmp := z.path + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer out.Close()
+
+	w := zip.NewWriter(out)
+	for i, f := range r.File {
+		if _, ok := z.broken[i]; ok {
+			continue
+		}
+		if err := w.Copy(f); err != nil {
+			return err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, z.path)
+}
@@ -0,0 +1,8 @@
+//go:build !(linux || darwin || freebsd)
+
+package services
+
+// freeSpace returns -1, as the free space can't be told on this platform.
+func freeSpace(dir string) (int64, error) {
+	return -1, nil
+}
@@ -0,0 +1,260 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/DeneesK/file-downloader/internal/app/model"
+)
+
+// Types of task events. A status event carries the task as GetTask returns
+// it, so the one announcing done has the archive URL.
+const (
+	EventStatus     = "status"
+	EventLinkDone   = "link_done"
+	EventLinkFailed = "link_failed"
+	EventProgress   = "progress"
+)
+
+const (
+	// eventHistory is how many recent events of a task are kept for clients
+	// resuming a stream.
+	eventHistory = 100
+	// eventRetention is how long the events of a finished task are kept.
+	eventRetention = 10 * time.Minute
+	// subscriberBuffer is how many events a subscriber may fall behind before
+	// it is dropped.
+	subscriberBuffer = 64
+)
+
+// Event is a change of a task pushed to its subscribers. IDs grow by one
+// within a task, so that a client can resume after the last event it got.
+type Event struct {
+	ID   uint64
+	Type string
+	Data json.RawMessage
+}
+
+// LinkEvent is the data of link_done and link_failed events.
+type LinkEvent struct {
+	URL         string `json:"url"`
+	Size        int64  `json:"size,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	SHA256      string `json:"sha256,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+type eventTopic struct {
+	seq     uint64
+	history []Event
+	subs    map[chan Event]struct{}
+	done    bool
+}
+
+// eventHub fans the events of tasks out to subscribers and keeps the recent
+// ones for clients that reconnect. A subscriber that doesn't keep up is
+// dropped rather than slowing the task down; it can resume from the last
+// event it got.
+type eventHub struct {
+	mu     sync.Mutex
+	topics map[string]*eventTopic
+	closed bool
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{topics: make(map[string]*eventTopic)}
+}
+
+func (h *eventHub) topic(taskID string) *eventTopic {
+	t, ok := h.topics[taskID]
+	if !ok {
+		t = &eventTopic{subs: make(map[chan Event]struct{})}
+		h.topics[taskID] = t
+	}
+	return t
+}
+
+// publish sends an event to the subscribers of the task. The final event
+// ends their subscriptions; the history is kept for eventRetention after it.
+func (h *eventHub) publish(taskID, typ string, data any, final bool) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	t := h.topic(taskID)
+	t.seq++
+	ev := Event{ID: t.seq, Type: typ, Data: payload}
+	t.history = append(t.history, ev)
+	if len(t.history) > eventHistory {
+		t.history = slices.Delete(t.history, 0, len(t.history)-eventHistory)
+	}
+
+	for ch := range t.subs {
+		select {
+		case ch <- ev:
+		default:
+			delete(t.subs, ch)
+			close(ch)
+		}
+	}
+
+	if final && !t.done {
+		t.done = true
+		for ch := range t.subs {
+			delete(t.subs, ch)
+			close(ch)
+		}
+		time.AfterFunc(eventRetention, func() {
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			if h.topics[taskID] == t {
+				delete(h.topics, taskID)
+			}
+		})
+	}
+	return nil
+}
+
+// subscribe returns the events after lastID and a channel of the events to
+// come. If the events after lastID are no longer kept, resumed is false and
+// seq is the ID of the last event published, which a snapshot of the task
+// should be sent under. The channel is closed right away if the task is
+// finished.
+func (h *eventHub) subscribe(taskID string, lastID uint64) (replay []Event, ch chan Event, resumed bool, seq uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	t := h.topic(taskID)
+	if lastID > 0 && lastID <= t.seq && (lastID == t.seq || len(t.history) > 0 && t.history[0].ID <= lastID+1) {
+		resumed = true
+		for _, ev := range t.history {
+			if ev.ID > lastID {
+				replay = append(replay, ev)
+			}
+		}
+	}
+
+	ch = make(chan Event, subscriberBuffer)
+	if t.done || h.closed {
+		close(ch)
+	} else {
+		t.subs[ch] = struct{}{}
+	}
+	return replay, ch, resumed, t.seq
+}
+
+func (h *eventHub) unsubscribe(taskID string, ch chan Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	t, ok := h.topics[taskID]
+	if !ok {
+		return
+	}
+	delete(t.subs, ch)
+	if len(t.subs) == 0 && t.seq == 0 {
+		delete(h.topics, taskID)
+	}
+}
+
+// close ends all subscriptions, so that open streams don't hold up the
+// shutdown of the server.
+func (h *eventHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+	for _, t := range h.topics {
+		for ch := range t.subs {
+			delete(t.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// Events streams the events of the task. Without lastEventID, or when the
+// events after it are no longer kept, the stream starts with a status event
+// carrying the current task. The channel is closed after the task finishes,
+// when ctx is done, or when the client falls behind and has to resume.
+func (s *taskService) Events(ctx context.Context, taskID string, lastEventID uint64) (<-chan Event, error) {
+	if _, err := s.taskStore.Get(ctx, taskID); err != nil {
+		return nil, err
+	}
+
+	replay, sub, resumed, seq := s.events.subscribe(taskID, lastEventID)
+	final := false
+	if !resumed {
+		task, err := s.GetTask(ctx, taskID)
+		if err != nil {
+			s.events.unsubscribe(taskID, sub)
+			return nil, err
+		}
+		data, err := json.Marshal(task)
+		if err != nil {
+			s.events.unsubscribe(taskID, sub)
+			return nil, err
+		}
+		replay = []Event{{ID: seq, Type: EventStatus, Data: data}}
+		final = task.IsTerminal()
+	}
+
+	out := make(chan Event)
+	go func() {
+		defer close(out)
+		defer s.events.unsubscribe(taskID, sub)
+
+		for _, ev := range replay {
+			select {
+			case out <- ev:
+			case <-ctx.Done():
+				return
+			}
+		}
+		if final {
+			return
+		}
+		for {
+			select {
+			case ev, ok := <-sub:
+				if !ok {
+					return
+				}
+				select {
+				case out <- ev:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+// statusChanged is called with the task after its new status is saved.
+func (s *taskService) statusChanged(task model.Task) {
+	s.publishTask(task)
+	if task.Callback != nil && task.Callback.Status == model.DeliveryPending {
+		s.enqueueCallback(task)
+	}
+}
+
+// publishTask announces the status of the task.
+func (s *taskService) publishTask(task model.Task) {
+	s.withArchiveLink(&task)
+	s.publish(task.ID, EventStatus, task, task.IsTerminal())
+}
+
+func (s *taskService) publish(taskID, typ string, data any, final bool) {
+	if err := s.events.publish(taskID, typ, data, final); err != nil {
+		s.log.Errorf("failed to publish %s event of task ID %s: %s", typ, taskID, err)
+	}
+}
@@ -0,0 +1,351 @@
+package services
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/DeneesK/file-downloader/pkg/downloader"
+)
+
+var ErrContentMismatch = errors.New("content is not of an allowed type")
+var ErrBadFileType = errors.New("not valid file type")
+
+// FileType is a kind of file that may be downloaded. It is recognised by the
+// extension of the link, the Content-Type of the response and the signature
+// the file starts with.
+type FileType struct {
+	Name       string   `json:"name"`
+	Extensions []string `json:"extensions,omitempty"`
+	MIMETypes  []string `json:"mime_types,omitempty"`
+	// Magic lists the signatures a file of the type may start with, in hex;
+	// "??" matches any byte.
+	Magic []string `json:"magic,omitempty"`
+	// Text marks types without a signature, whose content must be plain
+	// text instead.
+	Text bool `json:"text,omitempty"`
+	// MaxSize caps the size of a file of the type in bytes, 0 means no
+	// limit.
+	MaxSize int64 `json:"max_size,omitempty"`
+
+	signatures []signature
+}
+
+// signature is a parsed magic; bytes with a false mask match anything.
+type signature struct {
+	bytes []byte
+	mask  []bool
+}
+
+func (s signature) match(head []byte) bool {
+	if len(head) < len(s.bytes) {
+		return false
+	}
+	for i, b := range s.bytes {
+		if s.mask[i] && head[i] != b {
+			return false
+		}
+	}
+	return true
+}
+
+func parseSignature(magic string) (signature, error) {
+	magic = strings.ReplaceAll(magic, " ", "")
+	if magic == "" || len(magic)%2 != 0 {
+		return signature{}, fmt.Errorf("%w: bad magic %q", ErrBadFileType, magic)
+	}
+	s := signature{bytes: make([]byte, len(magic)/2), mask: make([]bool, len(magic)/2)}
+	for i := range s.bytes {
+		pair := magic[2*i : 2*i+2]
+		if pair == "??" {
+			continue
+		}
+		b, err := hex.DecodeString(pair)
+		if err != nil {
+			return signature{}, fmt.Errorf("%w: bad magic %q", ErrBadFileType, magic)
+		}
+		s.bytes[i], s.mask[i] = b[0], true
+	}
+	return s, nil
+}
+
+// compile checks the type and parses its signatures.
+func (t *FileType) compile() error {
+	if t.Name == "" {
+		return fmt.Errorf("%w: type has no name", ErrBadFileType)
+	}
+	if len(t.Extensions) == 0 {
+		return fmt.Errorf("%w: %s has no extensions", ErrBadFileType, t.Name)
+	}
+	for i, ext := range t.Extensions {
+		ext = strings.ToLower(ext)
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		t.Extensions[i] = ext
+	}
+	for i, mimeType := range t.MIMETypes {
+		t.MIMETypes[i] = strings.ToLower(mimeType)
+	}
+	if len(t.Magic) == 0 && !t.Text {
+		return fmt.Errorf("%w: %s has neither magic nor text set", ErrBadFileType, t.Name)
+	}
+	if t.MaxSize < 0 {
+		return fmt.Errorf("%w: %s has negative max size", ErrBadFileType, t.Name)
+	}
+	t.signatures = t.signatures[:0]
+	for _, magic := range t.Magic {
+		s, err := parseSignature(magic)
+		if err != nil {
+			return fmt.Errorf("%s: %w", t.Name, err)
+		}
+		t.signatures = append(t.signatures, s)
+	}
+	return nil
+}
+
+// matches reports whether the file starting with head is of the type.
+func (t FileType) matches(head []byte) bool {
+	if t.Text {
+		return sniff(head) == "text/plain"
+	}
+	return slices.ContainsFunc(t.signatures, func(s signature) bool { return s.match(head) })
+}
+
+// builtinFileTypes are the types that can be allowed by name.
+var builtinFileTypes = []FileType{
+	{Name: "pdf", Extensions: []string{".pdf"}, MIMETypes: []string{"application/pdf", "application/x-pdf"}, Magic: []string{"255044462d"}},
+	{Name: "jpeg", Extensions: []string{".jpg", ".jpeg"}, MIMETypes: []string{"image/jpeg", "image/pjpeg"}, Magic: []string{"ffd8ff"}},
+	{Name: "png", Extensions: []string{".png"}, MIMETypes: []string{"image/png"}, Magic: []string{"89504e470d0a1a0a"}},
+	{Name: "gif", Extensions: []string{".gif"}, MIMETypes: []string{"image/gif"}, Magic: []string{"474946383761", "474946383961"}},
+	{Name: "webp", Extensions: []string{".webp"}, MIMETypes: []string{"image/webp"}, Magic: []string{"52494646????????57454250"}},
+	{Name: "tiff", Extensions: []string{".tif", ".tiff"}, MIMETypes: []string{"image/tiff"}, Magic: []string{"49492a00", "4d4d002a"}},
+	{Name: "docx", Extensions: []string{".docx"}, MIMETypes: []string{"application/vnd.openxmlformats-officedocument.wordprocessingml.document"}, Magic: []string{"504b0304"}},
+	{Name: "xlsx", Extensions: []string{".xlsx"}, MIMETypes: []string{"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"}, Magic: []string{"504b0304"}},
+	{Name: "csv", Extensions: []string{".csv"}, MIMETypes: []string{"text/csv", "application/csv", "text/plain"}, Text: true},
+	{Name: "txt", Extensions: []string{".txt"}, MIMETypes: []string{"text/plain"}, Text: true},
+}
+
+var defaultFileTypes, _ = FileTypesByName([]string{"pdf", "jpeg"})
+
+// BuiltinFileTypes returns the names of the types that can be allowed by
+// name.
+func BuiltinFileTypes() []string {
+	names := make([]string, len(builtinFileTypes))
+	for i, t := range builtinFileTypes {
+		names[i] = t.Name
+	}
+	return names
+}
+
+func builtinFileType(name string) (FileType, bool) {
+	i := slices.IndexFunc(builtinFileTypes, func(t FileType) bool { return t.Name == name })
+	if i < 0 {
+		return FileType{}, false
+	}
+	t := builtinFileTypes[i]
+	t.Extensions = slices.Clone(t.Extensions)
+	t.MIMETypes = slices.Clone(t.MIMETypes)
+	t.Magic = slices.Clone(t.Magic)
+	return t, true
+}
+
+// FileTypesByName returns the built-in types with the names.
+func FileTypesByName(names []string) ([]FileType, error) {
+	types := make([]FileType, 0, len(names))
+	for _, name := range names {
+		t, ok := builtinFileType(strings.ToLower(strings.TrimSpace(name)))
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown type %q, built-in are %s", ErrBadFileType, name, strings.Join(BuiltinFileTypes(), ", "))
+		}
+		types = append(types, t)
+	}
+	return compileFileTypes(types)
+}
+
+// LoadFileTypes reads the allowed types from a JSON file with an array of
+// types. A type named after a built-in one takes the fields it doesn't set
+// from it, so {"name": "png", "max_size": 10485760} is enough to allow PNG
+// files up to 10 MiB.
+func LoadFileTypes(path string) ([]FileType, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var types []FileType
+	if err := json.Unmarshal(data, &types); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrBadFileType, err)
+	}
+	for i, t := range types {
+		builtin, ok := builtinFileType(t.Name)
+		if !ok {
+			continue
+		}
+		if t.Extensions == nil {
+			types[i].Extensions = builtin.Extensions
+		}
+		if t.MIMETypes == nil {
+			types[i].MIMETypes = builtin.MIMETypes
+		}
+		if t.Magic == nil && !t.Text {
+			types[i].Magic, types[i].Text = builtin.Magic, builtin.Text
+		}
+	}
+	return compileFileTypes(types)
+}
+
+func compileFileTypes(types []FileType) ([]FileType, error) {
+	if len(types) == 0 {
+		return nil, fmt.Errorf("%w: no types allowed", ErrBadFileType)
+	}
+	for i := range types {
+		if err := types[i].compile(); err != nil {
+			return nil, err
+		}
+	}
+	return types, nil
+}
+
+// WithFileTypes sets the types of files that may be downloaded.
+func WithFileTypes(types []FileType) Option {
+	return func(s *taskService) {
+		s.fileTypes = types
+	}
+}
+
+// genericTypes say nothing about the content, so only the signatures of
+// files sent with them are checked.
+var genericTypes = map[string]struct{}{
+	"":                           {},
+	"application/octet-stream":   {},
+	"binary/octet-stream":        {},
+	"application/download":       {},
+	"application/force-download": {},
+}
+
+// sniff returns the media type the content starting with head looks like.
+func sniff(head []byte) string {
+	mediaType, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+	return mediaType
+}
+
+// linkExt returns the lowercased extension of the URL path.
+func linkExt(link string) string {
+	u, err := url.Parse(link)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(path.Ext(u.Path))
+}
+
+// contentCheck makes sure a download is what its link promises: a file of
+// the type its extension stands for, or of any allowed type if the link has
+// no extension.
+type contentCheck struct {
+	expect []FileType
+	// found is the type the content turned out to be.
+	found *FileType
+}
+
+func (s *taskService) newContentCheck(link string) *contentCheck {
+	ext := linkExt(link)
+	if ext == "" {
+		return &contentCheck{expect: s.fileTypes}
+	}
+	c := &contentCheck{}
+	for _, t := range s.fileTypes {
+		if slices.Contains(t.Extensions, ext) {
+			c.expect = append(c.expect, t)
+		}
+	}
+	return c
+}
+
+// check is the downloader.State check. It also limits the download to the
+// max size of the type found, if that is lower than the limit set.
+func (c *contentCheck) check(st *downloader.State, head []byte) error {
+	mediaType, _, err := mime.ParseMediaType(st.ContentType)
+	if err != nil {
+		mediaType = strings.TrimSpace(st.ContentType)
+	}
+	mediaType = strings.ToLower(mediaType)
+	_, generic := genericTypes[mediaType]
+	if !generic && !slices.ContainsFunc(c.expect, func(t FileType) bool {
+		return slices.Contains(t.MIMETypes, mediaType)
+	}) {
+		return fmt.Errorf("%w: server sent %s, expected %s", ErrContentMismatch, mediaType, c.expected())
+	}
+
+	// Types may share a signature, like docx and xlsx, so the one the
+	// server named is preferred.
+	for i, t := range c.expect {
+		if t.matches(head) && (c.found == nil || slices.Contains(t.MIMETypes, mediaType)) {
+			c.found = &c.expect[i]
+		}
+	}
+	if c.found == nil {
+		return fmt.Errorf("%w: content looks like %s, expected %s", ErrContentMismatch, sniff(head), c.expected())
+	}
+	if limit := c.found.MaxSize; limit > 0 && (st.MaxSize <= 0 || limit < st.MaxSize) {
+		st.MaxSize = limit
+	}
+	return nil
+}
+
+func (c *contentCheck) expected() string {
+	names := make([]string, len(c.expect))
+	for i, t := range c.expect {
+		names[i] = t.Name
+	}
+	return strings.Join(names, " or ")
+}
+
+// contentType returns the Content-Type to record for the download: the one
+// the server sent unless it was generic.
+func (c *contentCheck) contentType(sent string) string {
+	mediaType, _, _ := mime.ParseMediaType(sent)
+	if _, generic := genericTypes[strings.ToLower(mediaType)]; generic && c.found != nil && len(c.found.MIMETypes) > 0 {
+		return c.found.MIMETypes[0]
+	}
+	return sent
+}
+
+// ext returns the extension for an entry whose name has none.
+func (c *contentCheck) ext() string {
+	if c.found == nil {
+		return ""
+	}
+	return c.found.Extensions[0]
+}
+
+// RejectedLinksError explains why links can't be added, by link. It is an
+// ErrNotValidExaction.
+type RejectedLinksError struct {
+	Links map[string]string
+}
+
+func (e *RejectedLinksError) Error() string {
+	links := make([]string, 0, len(e.Links))
+	for link := range e.Links {
+		links = append(links, link)
+	}
+	sort.Strings(links)
+	reasons := make([]string, len(links))
+	for i, link := range links {
+		reasons[i] = link + ": " + e.Links[link]
+	}
+	return fmt.Sprintf("%s: %s", ErrNotValidExaction, strings.Join(reasons, "; "))
+}
+
+func (e *RejectedLinksError) Is(target error) bool {
+	return target == ErrNotValidExaction
+}
@@ -0,0 +1,267 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/DeneesK/file-downloader/internal/app/model"
+	"github.com/google/uuid"
+)
+
+// JanitorConfig sets the retention rules. Zero ArchiveTTL or MaxArchiveBytes
+// turn the corresponding rule off.
+type JanitorConfig struct {
+	Interval        time.Duration
+	ArchiveTTL      time.Duration
+	MaxArchiveBytes int64
+	DownloadDir     string
+	ArchiveDir      string
+	OrphanAge       time.Duration
+}
+
+// janitor periodically removes archives that outlived their TTL or don't fit
+// into the size limit, least recently downloaded first, and temporary files
+// no task refers to anymore.
+type janitor struct {
+	tasks *taskService
+	log   Logger
+	cfg   JanitorConfig
+	// started is when the janitor was created. Archives written since may
+	// belong to a running task, which records its archive only when it is
+	// finished.
+	started time.Time
+}
+
+func NewJanitor(tasks *taskService, log Logger, cfg JanitorConfig) *janitor {
+	if cfg.Interval <= 0 {
+		cfg.Interval = 10 * time.Minute
+	}
+	return &janitor{tasks: tasks, log: log, cfg: cfg, started: time.Now()}
+}
+
+func (j *janitor) Start(ctx context.Context) {
+	j.log.Infoln("janitor started, collecting every", j.cfg.Interval)
+
+	ticker := time.NewTicker(j.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		j.collect(ctx)
+		select {
+		case <-ctx.Done():
+			j.log.Infoln("janitor stopped")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (j *janitor) collect(ctx context.Context) {
+	tasks, err := j.tasks.taskStore.List(ctx)
+	if err != nil {
+		j.log.Errorf("janitor failed to list tasks: %s", err)
+		return
+	}
+
+	j.expireArchives(ctx, tasks)
+	j.removeOrphans(tasks)
+	j.removeOrphanedArchives(tasks)
+}
+
+type storedArchive struct {
+	task       model.Task
+	size       int64
+	lastAccess time.Time
+}
+
+func (j *janitor) expireArchives(ctx context.Context, tasks []model.Task) {
+	now := time.Now()
+	var archives []storedArchive
+	var total int64
+
+	for _, task := range tasks {
+		if task.Status != model.StatusDone {
+			continue
+		}
+		fi, err := os.Stat(task.Archive)
+		if err != nil {
+			j.expire(ctx, task, "archive file is missing")
+			continue
+		}
+		if j.cfg.ArchiveTTL > 0 && now.Sub(fi.ModTime()) > j.cfg.ArchiveTTL {
+			j.expire(ctx, task, fmt.Sprintf("archive is older than %s", j.cfg.ArchiveTTL))
+			continue
+		}
+
+		lastAccess := fi.ModTime()
+		if task.LastAccessAt.After(lastAccess) {
+			lastAccess = task.LastAccessAt
+		}
+		archives = append(archives, storedArchive{task: task, size: fi.Size(), lastAccess: lastAccess})
+		total += fi.Size()
+	}
+
+	if j.cfg.MaxArchiveBytes <= 0 || total <= j.cfg.MaxArchiveBytes {
+		return
+	}
+	sort.Slice(archives, func(a, b int) bool {
+		return archives[a].lastAccess.Before(archives[b].lastAccess)
+	})
+	for _, a := range archives {
+		if total <= j.cfg.MaxArchiveBytes {
+			return
+		}
+		j.expire(ctx, a.task, fmt.Sprintf("archive was evicted to keep archives under %d bytes", j.cfg.MaxArchiveBytes))
+		total -= a.size
+	}
+}
+
+func (j *janitor) expire(ctx context.Context, task model.Task, reason string) {
+	expired, err := j.tasks.expireArchive(ctx, task.ID, task.Archive, reason)
+	if err != nil {
+		j.log.Errorf("janitor failed to expire task ID %s: %s", task.ID, err)
+		return
+	}
+	if expired {
+		j.log.Infoln("janitor expired task ID", task.ID+":", reason)
+	}
+}
+
+// expireArchive removes the archive of a finished task and marks the task
+// expired. It reports false if the task is no longer done with that archive.
+func (s *taskService) expireArchive(ctx context.Context, taskID, archive, reason string) (bool, error) {
+	s.lifecycle.Lock()
+	defer s.lifecycle.Unlock()
+
+	task, err := s.taskStore.Get(ctx, taskID)
+	if err != nil {
+		return false, err
+	}
+	if task.Status != model.StatusDone || task.Archive != archive {
+		return false, nil
+	}
+	if err := os.Remove(task.Archive); err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	if err := task.SetStatus(model.StatusExpired); err != nil {
+		return false, err
+	}
+	task.ExpiredReason = reason
+	if err := s.taskStore.Update(ctx, task); err != nil {
+		return false, err
+	}
+	s.statusChanged(task)
+	return true, nil
+}
+
+// removeOrphans deletes files in the download dir that no unfinished task
+// refers to, and the directories of tasks that are finished or gone.
+// Recently modified ones are kept, as they may belong to a download that has
+// not saved its progress yet.
+func (j *janitor) removeOrphans(tasks []model.Task) {
+	if j.cfg.DownloadDir == "" {
+		return
+	}
+	referenced := make(map[string]struct{})
+	for _, task := range tasks {
+		if task.IsTerminal() {
+			continue
+		}
+		referenced[filepath.Join(j.cfg.DownloadDir, task.ID)] = struct{}{}
+		for _, d := range task.Downloads {
+			referenced[filepath.Clean(d.Path)] = struct{}{}
+		}
+	}
+	j.removeUnreferenced(j.cfg.DownloadDir, referenced, time.Now(), isDownloadName)
+}
+
+// removeOrphanedArchives deletes files in the archive dir that no finished
+// task refers to: archives and their temporary files left by a crash, whose
+// tasks start a new archive when they are recovered.
+func (j *janitor) removeOrphanedArchives(tasks []model.Task) {
+	if j.cfg.ArchiveDir == "" {
+		return
+	}
+	referenced := make(map[string]struct{})
+	for _, task := range tasks {
+		if task.Status == model.StatusDone {
+			referenced[filepath.Clean(task.Archive)] = struct{}{}
+		}
+	}
+	j.removeUnreferenced(j.cfg.ArchiveDir, referenced, j.started, isArchiveName)
+}
+
+// removeUnreferenced deletes the entries of dir that are named the way the
+// service names them, are not referenced, were last modified before
+// notAfter and are older than the orphan age. Anything else is left alone,
+// as dir may be shared with other programs.
+func (j *janitor) removeUnreferenced(dir string, referenced map[string]struct{}, notAfter time.Time, owned func(e os.DirEntry) bool) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		j.log.Errorf("janitor failed to read dir %s: %s", dir, err)
+		return
+	}
+	for _, e := range entries {
+		if !owned(e) {
+			continue
+		}
+		path := filepath.Join(dir, e.Name())
+		if _, ok := referenced[path]; ok {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil || time.Since(fi.ModTime()) < j.cfg.OrphanAge || fi.ModTime().After(notAfter) {
+			continue
+		}
+		if err := os.RemoveAll(path); err != nil {
+			j.log.Errorf("janitor failed to remove orphaned file %s: %s", path, err)
+			continue
+		}
+		j.log.Infoln("janitor removed orphaned file", path)
+	}
+}
+
+// isTaskID reports whether name is a task ID, a UUID in its canonical form.
+func isTaskID(name string) bool {
+	return len(name) == 36 && uuid.Validate(name) == nil
+}
+
+// isDownloadName reports whether the entry of the download dir is one the
+// service creates: a download named <uuid><ext> or the directory of a task.
+func isDownloadName(e os.DirEntry) bool {
+	name := e.Name()
+	if e.IsDir() {
+		return isTaskID(name)
+	}
+	if !e.Type().IsRegular() || len(name) < 36 || !isTaskID(name[:36]) {
+		return false
+	}
+	ext := name[36:]
+	return ext == "" || ext == filepath.Ext(name)
+}
+
+// isArchiveName reports whether the entry of the archive dir is one the
+// service creates: an archive named <uuid><format ext>, the copy of a zip
+// archive being compacted or a tar entry being spooled.
+func isArchiveName(e os.DirEntry) bool {
+	name := e.Name()
+	if !e.Type().IsRegular() {
+		return false
+	}
+	if strings.HasPrefix(name, ".entry-") {
+		return true
+	}
+	if len(name) < 36 || !isTaskID(name[:36]) {
+		return false
+	}
+	switch name[36:] {
+	case FormatZip.Ext, FormatZip.Ext + ".tmp", FormatTar.Ext, FormatTarGz.Ext, FormatTarZst.Ext:
+		return true
+	}
+	return false
+}
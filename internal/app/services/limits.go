@@ -0,0 +1,113 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/DeneesK/file-downloader/internal/app/model"
+	"github.com/DeneesK/file-downloader/pkg/downloader"
+)
+
+var ErrLowDiskSpace = errors.New("not enough free disk space")
+
+// WithSizeLimits caps the size of each downloaded file and the total size of
+// the files of a task, in bytes. 0 means no limit.
+func WithSizeLimits(fileBytes, taskBytes int64) Option {
+	return func(s *taskService) {
+		s.maxFileBytes = fileBytes
+		s.maxTaskBytes = taskBytes
+	}
+}
+
+// WithDiskGuard makes the service refuse new tasks while the file system of
+// dir has less than minFree bytes available.
+func WithDiskGuard(dir string, minFree int64) Option {
+	return func(s *taskService) {
+		s.diskDir = dir
+		s.minFreeSpace = minFree
+	}
+}
+
+func (s *taskService) checkDiskSpace() error {
+	if s.minFreeSpace <= 0 {
+		return nil
+	}
+	if err := os.MkdirAll(s.diskDir, filePerm); err != nil {
+		return err
+	}
+	free, err := freeSpace(s.diskDir)
+	if err != nil {
+		return err
+	}
+	if free >= 0 && free < s.minFreeSpace {
+		s.log.Errorf("refused a new task: %d bytes free in %s, at least %d needed", free, s.diskDir, s.minFreeSpace)
+		return fmt.Errorf("%w: %d bytes available, at least %d needed", ErrLowDiskSpace, free, s.minFreeSpace)
+	}
+	return nil
+}
+
+// taskQuota caps the total size of the files of a task. Every link claims
+// the size of its file as it becomes known, so a download that is retried or
+// resumed isn't counted twice.
+type taskQuota struct {
+	mu     sync.Mutex
+	limit  int64
+	total  int64
+	claims map[string]int64
+}
+
+// newTaskQuota returns the quota of a task, counting what earlier runs have
+// already downloaded, or nil if there is no limit.
+func newTaskQuota(task model.Task, limit int64) *taskQuota {
+	if limit <= 0 {
+		return nil
+	}
+	q := &taskQuota{limit: limit, claims: make(map[string]int64, len(task.Links))}
+	for link, d := range task.Downloads {
+		if _, failed := task.FailedLinks[link]; !failed {
+			q.claims[link] = d.Offset
+			q.total += d.Offset
+		}
+	}
+	return q
+}
+
+// claimer returns the downloader.State claim of a link, nil without a quota.
+func (q *taskQuota) claimer(link string) func(size int64) error {
+	if q == nil {
+		return nil
+	}
+	return func(size int64) error {
+		return q.claim(link, size)
+	}
+}
+
+func (q *taskQuota) claim(link string, size int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	extra := size - q.claims[link]
+	if extra <= 0 {
+		return nil
+	}
+	if q.total+extra > q.limit {
+		return fmt.Errorf("%w: task would exceed its limit of %d bytes", downloader.ErrTooLarge, q.limit)
+	}
+	q.claims[link] = size
+	q.total += extra
+	return nil
+}
+
+// release frees the bytes of a link that failed, as its file is left out of
+// the archive.
+func (q *taskQuota) release(link string) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.total -= q.claims[link]
+	delete(q.claims, link)
+}
@@ -0,0 +1,125 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/DeneesK/file-downloader/internal/app/model"
+)
+
+const (
+	manifestName  = "manifest.json"
+	checksumsName = "SHA256SUMS"
+)
+
+// manifestEntry describes one link of the task. Links that failed have no
+// entry in the archive and carry the error instead.
+type manifestEntry struct {
+	URL          string     `json:"url"`
+	Entry        string     `json:"entry,omitempty"`
+	Size         int64      `json:"size,omitempty"`
+	ContentType  string     `json:"content_type,omitempty"`
+	SHA256       string     `json:"sha256,omitempty"`
+	DownloadedAt *time.Time `json:"downloaded_at,omitempty"`
+	StatusCode   int        `json:"status_code,omitempty"`
+	Error        string     `json:"error,omitempty"`
+}
+
+type manifest struct {
+	TaskID    string          `json:"task_id"`
+	CreatedAt time.Time       `json:"created_at"`
+	Files     []manifestEntry `json:"files"`
+}
+
+// buildManifest returns the contents of manifest.json and SHA256SUMS, the
+// latter in the format read by sha256sum -c.
+func buildManifest(task model.Task) ([]byte, []byte, error) {
+	m := manifest{TaskID: task.ID, CreatedAt: time.Now().UTC(), Files: make([]manifestEntry, 0, len(task.Links))}
+	var sums bytes.Buffer
+
+	for _, link := range task.Links {
+		e := manifestEntry{URL: link}
+		if reason, failed := task.FailedLinks[link]; failed {
+			e.Error = reason
+			if attempts := task.Attempts[link]; len(attempts) > 0 {
+				e.StatusCode = attempts[len(attempts)-1].StatusCode
+			}
+		} else if d, ok := task.Downloads[link]; ok && d.Done {
+			downloadedAt := d.DownloadedAt.UTC()
+			e.Entry = d.Entry
+			e.Size = d.Offset
+			e.ContentType = d.ContentType
+			e.SHA256 = d.SHA256
+			e.DownloadedAt = &downloadedAt
+			e.StatusCode = d.StatusCode
+			fmt.Fprintf(&sums, "%s  %s\n", d.SHA256, d.Entry)
+		}
+		m.Files = append(m.Files, e)
+	}
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, sums.Bytes(), nil
+}
+
+// writeManifest adds the manifest and checksums to the archive. In streaming
+// mode they go straight into the stream; otherwise they are written to a dir
+// of the task, whose files are returned to be archived along with the
+// downloads.
+func (s *taskService) writeManifest(task model.Task, stream ArchiveStream) ([]ArchiveFile, error) {
+	data, sums, err := buildManifest(task)
+	if err != nil {
+		return nil, err
+	}
+	files := []struct {
+		name string
+		data []byte
+	}{{manifestName, data}, {checksumsName, sums}}
+
+	if stream != nil {
+		for _, f := range files {
+			w, err := stream.Create(f.name)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := w.Write(f.data); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	}
+
+	dir := s.manifestDir(task.ID)
+	if err := os.MkdirAll(dir, filePerm); err != nil {
+		return nil, err
+	}
+	archiveFiles := make([]ArchiveFile, 0, len(files))
+	for _, f := range files {
+		path := filepath.Join(dir, f.name)
+		if err := os.WriteFile(path, f.data, 0644); err != nil {
+			os.RemoveAll(dir)
+			return nil, err
+		}
+		archiveFiles = append(archiveFiles, ArchiveFile{Path: path, Name: f.name})
+	}
+	return archiveFiles, nil
+}
+
+func (s *taskService) manifestDir(taskID string) string {
+	return filepath.Join(s.downloadDir, taskID)
+}
+
+// manifestEnabled reports whether the archive of a task with opts gets a
+// manifest.
+func (s *taskService) manifestEnabled(opts model.TaskOptions) bool {
+	if opts.Manifest != nil {
+		return *opts.Manifest
+	}
+	return s.manifest
+}
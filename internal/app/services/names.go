@@ -0,0 +1,137 @@
+package services
+
+import (
+	"fmt"
+	"mime"
+	"net/url"
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const maxNameLen = 255
+
+// maxExtLen caps the length of what counts as an extension; a longer one is
+// taken as part of the stem, so a name can always be cut to fit.
+const maxExtLen = 32
+
+// entryName picks the name of the archive entry for a link: the name set by
+// the client, the filename suggested by Content-Disposition, or the last
+// segment of the URL path. A name without an extension borrows the one of
+// the URL path, or ext if the URL has none either.
+func entryName(explicit, contentDisposition, link, ext string) string {
+	urlName := ""
+	if u, err := url.Parse(link); err == nil {
+		urlName = sanitizeName(path.Base(u.Path))
+	}
+
+	name := sanitizeName(explicit)
+	if name == "" {
+		if _, params, err := mime.ParseMediaType(contentDisposition); err == nil {
+			name = sanitizeName(params["filename"])
+		}
+	}
+	if name == "" {
+		name = urlName
+	}
+	if name == "" {
+		name = "file"
+	}
+	if nameExt(name) == "" {
+		name += nameExt(urlName)
+	}
+	if nameExt(name) == "" {
+		name += ext
+	}
+	return truncateName(name, maxNameLen)
+}
+
+// nameExt returns the extension of name, or an empty string if it has none
+// or it is longer than maxExtLen.
+func nameExt(name string) string {
+	if ext := path.Ext(name); len(ext) <= maxExtLen {
+		return ext
+	}
+	return ""
+}
+
+// windowsReserved are names that can't be used for files on Windows, with
+// any extension.
+var windowsReserved = map[string]struct{}{
+	"CON": {}, "PRN": {}, "AUX": {}, "NUL": {},
+	"COM1": {}, "COM2": {}, "COM3": {}, "COM4": {}, "COM5": {}, "COM6": {}, "COM7": {}, "COM8": {}, "COM9": {},
+	"LPT1": {}, "LPT2": {}, "LPT3": {}, "LPT4": {}, "LPT5": {}, "LPT6": {}, "LPT7": {}, "LPT8": {}, "LPT9": {},
+}
+
+// sanitizeName makes name safe to extract on any system: directories are
+// dropped, control and reserved characters replaced, and the length capped.
+// It returns an empty string if nothing usable is left.
+func sanitizeName(name string) string {
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r == utf8.RuneError || unicode.IsControl(r):
+			return -1
+		case strings.ContainsRune(`<>:"|?*`, r):
+			return '_'
+		}
+		return r
+	}, name)
+	name = strings.Trim(name, " .")
+	if name == "" {
+		return ""
+	}
+
+	base := strings.ToUpper(strings.SplitN(name, ".", 2)[0])
+	if _, ok := windowsReserved[base]; ok {
+		name = "_" + name
+	}
+	return truncateName(name, maxNameLen)
+}
+
+// truncateName cuts name to n bytes keeping its extension and whole runes.
+func truncateName(name string, n int) string {
+	if len(name) <= n {
+		return name
+	}
+	if n <= 0 {
+		return ""
+	}
+	ext := nameExt(name)
+	if len(ext) >= n {
+		ext = ""
+	}
+	stem := name[:n-len(ext)]
+	for !utf8.ValidString(stem) {
+		stem = stem[:len(stem)-1]
+	}
+	return stem + ext
+}
+
+// entryNames hands out unique entry names. A name that is taken gets the
+// first free numeric suffix, so the same names in the same order always
+// come out the same. Names are compared case-insensitively, as archives are
+// often extracted on case-insensitive file systems.
+type entryNames map[string]struct{}
+
+func (n entryNames) reserve(name string) string {
+	unique := name
+	ext := nameExt(name)
+	stem := strings.TrimSuffix(name, ext)
+	for i := 1; ; i++ {
+		if _, taken := n[strings.ToLower(unique)]; !taken {
+			break
+		}
+		suffix := fmt.Sprintf(" (%d)", i)
+		unique = truncateName(stem, maxNameLen-len(suffix)-len(ext)) + suffix + ext
+	}
+	n[strings.ToLower(unique)] = struct{}{}
+	return unique
+}
+
+func (n entryNames) release(name string) {
+	delete(n, strings.ToLower(name))
+}
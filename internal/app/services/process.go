@@ -0,0 +1,547 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/DeneesK/file-downloader/internal/app/model"
+	"github.com/DeneesK/file-downloader/pkg/downloader"
+	"github.com/google/uuid"
+)
+
+// taskRun guards a task that is updated by several link workers at once.
+type taskRun struct {
+	mu       sync.Mutex
+	task     model.Task
+	store    TaskStorage
+	names    entryNames
+	progress *progressTracker
+	quota    *taskQuota
+	// onStatus is called with the task after each status change is saved.
+	onStatus func(task model.Task)
+}
+
+func (r *taskRun) update(ctx context.Context, fn func(task *model.Task)) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fn(&r.task)
+	return r.store.Update(context.WithoutCancel(ctx), r.task)
+}
+
+func (r *taskRun) setStatus(ctx context.Context, status string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.task.SetStatus(status); err != nil {
+		return err
+	}
+	if err := r.store.Update(context.WithoutCancel(ctx), r.task); err != nil {
+		return err
+	}
+	r.onStatus(r.task.Clone())
+	return nil
+}
+
+func (r *taskRun) snapshot() model.Task {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.task.Clone()
+}
+
+// runningTask lets CancelTask interrupt a task and wait until it stops, and
+// GetTask read its live progress.
+type runningTask struct {
+	cancel   context.CancelCauseFunc
+	done     chan struct{}
+	progress *progressTracker
+}
+
+// startRun moves the task to running and registers it, so that it can be
+// canceled. A task canceled while it was waiting in the queue is skipped.
+func (s *taskService) startRun(ctx context.Context, taskID string, cancel context.CancelCauseFunc) (*taskRun, error) {
+	s.lifecycle.Lock()
+	defer s.lifecycle.Unlock()
+
+	task, err := s.taskStore.Get(ctx, taskID)
+	if err != nil {
+		return nil, err
+	}
+	if err := task.SetStatus(model.StatusRunning); err != nil {
+		return nil, err
+	}
+	if s.streaming {
+		task.DownloadedFiles = task.DownloadedFiles[:0]
+	}
+	if err := s.taskStore.Update(ctx, task); err != nil {
+		return nil, err
+	}
+
+	s.statusChanged(task)
+
+	progress := newProgressTracker(task, s.progressInterval)
+	s.running[taskID] = &runningTask{cancel: cancel, done: make(chan struct{}), progress: progress}
+	return &taskRun{task: task, store: s.taskStore, progress: progress, quota: newTaskQuota(task, s.maxTaskBytes), onStatus: s.statusChanged}, nil
+}
+
+func (s *taskService) finishRun(taskID string) {
+	s.lifecycle.Lock()
+	defer s.lifecycle.Unlock()
+	if rt, ok := s.running[taskID]; ok {
+		close(rt.done)
+		delete(s.running, taskID)
+	}
+}
+
+func (s *taskService) processTask(ctx context.Context, taskID string) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	run, err := s.startRun(ctx, taskID, cancel)
+	if errors.Is(err, model.ErrInvalidTransition) {
+		s.log.Infoln("task skipped:", taskID, err)
+		return
+	} else if err != nil {
+		s.log.Errorf("during process of task ID %s error %v", taskID, err)
+		return
+	}
+	defer s.finishRun(taskID)
+	defer s.decrementActiveTasks()
+	s.log.Infoln("started process of task ID ", taskID)
+	task := run.snapshot()
+
+	_, archiver, err := s.archivers.Get(task.Format)
+	if err != nil {
+		s.log.Errorf("during process task ID %s error %s", taskID, err)
+		run.setStatus(ctx, model.StatusFailed)
+		return
+	}
+	archiveOpts, err := s.taskArchiveOptions(task)
+	if err != nil {
+		s.log.Errorf("during process task ID %s error %s", taskID, err)
+		run.setStatus(ctx, model.StatusFailed)
+		return
+	}
+
+	run.names = make(entryNames)
+	if s.manifestEnabled(task.TaskOptions) {
+		run.names.reserve(manifestName)
+		run.names.reserve(checksumsName)
+	}
+
+	var stream ArchiveStream
+	if s.streaming {
+		stream, err = archiver.NewStream(archiveOpts)
+		if err != nil {
+			s.log.Errorf("during process task ID %s error %s", taskID, err)
+			run.setStatus(ctx, model.StatusFailed)
+			return
+		}
+		defer func() {
+			if stream != nil {
+				stream.Abort()
+			}
+		}()
+	}
+
+	s.fetchLinks(ctx, run, s.pendingLinks(task), stream)
+	if ctx.Err() != nil {
+		s.interrupt(ctx, run)
+		return
+	}
+
+	task = run.snapshot()
+	if len(task.DownloadedFiles) == 0 {
+		run.setStatus(ctx, model.StatusFailed)
+		return
+	}
+
+	run.setStatus(ctx, model.StatusArchiving)
+	started := time.Now()
+	var files []ArchiveFile
+	if stream == nil {
+		files = s.nameEntries(ctx, run)
+		task = run.snapshot()
+	}
+	if s.manifestEnabled(task.TaskOptions) {
+		manifestFiles, err := s.writeManifest(task, stream)
+		if err != nil {
+			s.log.Errorf("during process of task ID %s failed to write manifest: %v", taskID, err)
+			run.setStatus(ctx, model.StatusFailed)
+			return
+		}
+		if manifestFiles != nil {
+			defer os.RemoveAll(s.manifestDir(taskID))
+		}
+		files = append(files, manifestFiles...)
+	}
+
+	var archive string
+	if stream != nil {
+		archive, err = stream.Close()
+		stream = nil
+	} else {
+		archive, err = archiver.CreateArchive(files, archiveOpts)
+		s.removeFiles(task.DownloadedFiles)
+	}
+	if err != nil {
+		s.log.Errorf("during process of task ID %s error %v", taskID, err)
+		run.setStatus(ctx, model.StatusFailed)
+		return
+	}
+	s.log.Infoln("archive of task ID", taskID, "created in", time.Since(started))
+	// Only a cancel drops the archive. The downloaded files are gone by now,
+	// so a task interrupted by shutdown falls through and is finished rather
+	// than queued to download everything again.
+	if errors.Is(context.Cause(ctx), ErrTaskCanceled) {
+		s.removeFiles([]string{archive})
+		s.interrupt(ctx, run)
+		return
+	}
+
+	run.update(ctx, func(task *model.Task) {
+		task.Archive = archive
+	})
+	run.setStatus(ctx, model.StatusDone)
+}
+
+// interrupt stops the task after its context was canceled. A canceled task
+// loses its partial files, while a task interrupted by shutdown goes back to
+// the queue with its progress kept.
+func (s *taskService) interrupt(ctx context.Context, run *taskRun) {
+	task := run.snapshot()
+	if !errors.Is(context.Cause(ctx), ErrTaskCanceled) {
+		s.log.Infoln("task interrupted:", task.ID)
+		run.setStatus(ctx, model.StatusQueued)
+		return
+	}
+
+	s.log.Infoln("task canceled:", task.ID)
+	paths := make([]string, 0, len(task.Downloads))
+	for _, d := range task.Downloads {
+		paths = append(paths, d.Path)
+	}
+	s.removeFiles(paths)
+	run.setStatus(ctx, model.StatusCanceled)
+}
+
+// pendingLinks returns the links that still have to be fetched. Links that
+// failed for good or were completely downloaded before an interruption are
+// skipped; an archive stream can't be continued, so streaming starts over.
+func (s *taskService) pendingLinks(task model.Task) []string {
+	links := make([]string, 0, len(task.Links))
+	for _, l := range task.Links {
+		if _, failed := task.FailedLinks[l]; failed {
+			continue
+		}
+		if d, ok := task.Downloads[l]; ok && d.Done && !s.streaming {
+			continue
+		}
+		links = append(links, l)
+	}
+	return links
+}
+
+// fetchLinks downloads the links using up to linkWorkers goroutines. Entries
+// of an archive stream can only be written one after another, so in streaming mode
+// the links are fetched sequentially.
+func (s *taskService) fetchLinks(ctx context.Context, run *taskRun, links []string, stream ArchiveStream) {
+	workers := s.linkWorkers
+	if stream != nil {
+		workers = 1
+	}
+	sem := make(chan struct{}, workers)
+
+	var wg sync.WaitGroup
+	for _, l := range links {
+		select {
+		case <-ctx.Done():
+		case sem <- struct{}{}:
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-sem }()
+				s.fetchLink(ctx, run, l, stream)
+			}()
+		}
+	}
+	wg.Wait()
+}
+
+func (s *taskService) fetchLink(ctx context.Context, run *taskRun, link string, stream ArchiveStream) {
+	var err error
+	if stream != nil {
+		d := model.Download{}
+		err = s.withRetry(ctx, run, link, &d, func() (int, error) {
+			return s.streamLink(ctx, run, link, stream, &d)
+		})
+		if err == nil {
+			run.progress.finish(link, d.Offset)
+			run.update(ctx, func(task *model.Task) {
+				task.DownloadedFiles = append(task.DownloadedFiles, link)
+				task.Progress = run.progress.snapshot()
+			})
+			s.publish(run.task.ID, EventLinkDone, linkDone(link, d), false)
+		}
+	} else {
+		run.mu.Lock()
+		d := model.Download{Path: filepath.Join(s.downloadDir, fileName(link))}
+		if saved, ok := run.task.Downloads[link]; ok {
+			d = *saved
+		}
+		name := run.task.Names[link]
+		run.mu.Unlock()
+
+		err = s.withRetry(ctx, run, link, &d, func() (int, error) {
+			return s.download(ctx, link, name, &d, s.reportProgress(ctx, run, link), run.quota.claimer(link))
+		})
+		if err == nil {
+			run.progress.finish(link, d.Offset)
+			run.update(ctx, func(task *model.Task) {
+				task.DownloadedFiles = append(task.DownloadedFiles, d.Path)
+				task.Progress = run.progress.snapshot()
+			})
+			s.publish(run.task.ID, EventLinkDone, linkDone(link, d), false)
+		}
+	}
+
+	if err != nil && ctx.Err() == nil {
+		s.log.Errorf("during process task ID %s failed to download file %v", run.task.ID, err)
+		run.progress.drop(link)
+		run.quota.release(link)
+		run.update(ctx, func(task *model.Task) {
+			task.FailedLinks[link] = fmt.Sprintf("%s", err)
+			task.Progress = run.progress.snapshot()
+		})
+		s.publish(run.task.ID, EventLinkFailed, LinkEvent{URL: link, Error: err.Error()}, false)
+	}
+}
+
+// withRetry runs fetch according to the retry policy and records the outcome
+// of every attempt in the task, together with the download progress d.
+func (s *taskService) withRetry(ctx context.Context, run *taskRun, link string, d *model.Download, fetch func() (int, error)) error {
+	maxAttempts := max(s.retry.MaxAttempts, 1)
+	for attempt := 1; ; attempt++ {
+		a := model.Attempt{Number: attempt, StartedAt: time.Now()}
+		statusCode, err := fetch()
+		a.StatusCode = statusCode
+		if err != nil {
+			a.Error = err.Error()
+		}
+
+		uErr := run.update(ctx, func(task *model.Task) {
+			if d != nil {
+				saved := *d
+				task.Downloads[link] = &saved
+			}
+			if ctx.Err() == nil {
+				task.Attempts[link] = append(task.Attempts[link], a)
+			}
+		})
+		if uErr != nil {
+			s.log.Errorf("during process task ID %s error %s", run.task.ID, uErr)
+		}
+
+		if err == nil || ctx.Err() != nil || attempt >= maxAttempts || !s.retry.retryable(err) {
+			return err
+		}
+
+		delay := s.retry.delay(attempt, err)
+		s.log.Infoln("task ID", run.task.ID, "retrying", link, "in", delay, "after error:", err)
+		if sleepErr := sleep(ctx, delay); sleepErr != nil {
+			return err
+		}
+	}
+}
+
+// download fetches the link into d.Path, continuing from d.Offset when a
+// previous attempt left a partial file behind. Content that isn't what the
+// link promises is rejected before it is stored, and so is a file too large
+// for the limits. The entry name is settled when the task is archived,
+// d.Entry only keeps the preferred one.
+func (s *taskService) download(ctx context.Context, link, name string, d *model.Download, progress func(received, total int64), claim func(size int64) error) (int, error) {
+	check := s.newContentCheck(link)
+	st := &downloader.State{
+		Path:         d.Path,
+		Offset:       d.Offset,
+		Size:         d.Size,
+		ETag:         d.ETag,
+		LastModified: d.LastModified,
+		Done:         d.Done,
+		ContentType:  d.ContentType,
+		Progress:     progress,
+		Check:        check.check,
+		MaxSize:      s.maxFileBytes,
+		Claim:        claim,
+	}
+	err := s.downloader.Resume(ctx, link, st)
+
+	d.Offset = st.Offset
+	d.Size = st.Size
+	d.ETag = st.ETag
+	d.LastModified = st.LastModified
+	d.Done = st.Done
+	d.ContentType = check.contentType(st.ContentType)
+	if err != nil {
+		return st.StatusCode, err
+	}
+
+	d.SHA256, err = hashFile(d.Path)
+	if err != nil {
+		return st.StatusCode, err
+	}
+	d.Entry = entryName(name, st.ContentDisposition, link, check.ext())
+	d.StatusCode = st.StatusCode
+	d.DownloadedAt = time.Now()
+	return st.StatusCode, nil
+}
+
+// streamLink pipes the response body straight into a new archive entry. An
+// entry that fails partway through is discarded from the archive.
+func (s *taskService) streamLink(ctx context.Context, run *taskRun, link string, stream ArchiveStream, d *model.Download) (int, error) {
+	run.mu.Lock()
+	explicit := run.task.Names[link]
+	run.mu.Unlock()
+
+	check := s.newContentCheck(link)
+	st := &downloader.State{
+		Progress: s.reportProgress(ctx, run, link),
+		Check:    check.check,
+		MaxSize:  s.maxFileBytes,
+		Claim:    run.quota.claimer(link),
+	}
+	name, created := "", false
+	hash := sha256.New()
+	err := s.downloader.Stream(ctx, link, st, func(st *downloader.State) (io.Writer, error) {
+		run.mu.Lock()
+		name = run.names.reserve(entryName(explicit, st.ContentDisposition, link, check.ext()))
+		run.mu.Unlock()
+		w, err := stream.Create(name)
+		if err != nil {
+			return nil, err
+		}
+		created = true
+		return io.MultiWriter(w, hash), nil
+	})
+	if err != nil {
+		// Discarding an entry that failed to be created would drop the
+		// previous one.
+		if created {
+			stream.Discard()
+		}
+		if name != "" {
+			run.mu.Lock()
+			run.names.release(name)
+			run.mu.Unlock()
+		}
+		return st.StatusCode, err
+	}
+
+	*d = model.Download{
+		Offset:       st.Offset,
+		Size:         st.Size,
+		ETag:         st.ETag,
+		LastModified: st.LastModified,
+		Done:         true,
+		Entry:        name,
+		ContentType:  check.contentType(st.ContentType),
+		SHA256:       hex.EncodeToString(hash.Sum(nil)),
+		StatusCode:   st.StatusCode,
+		DownloadedAt: time.Now(),
+	}
+	return st.StatusCode, nil
+}
+
+// reportProgress returns the progress callback for a link, which records the
+// progress, publishes it every progressEventInterval and now and then saves
+// it with the task.
+func (s *taskService) reportProgress(ctx context.Context, run *taskRun, link string) func(received, total int64) {
+	return func(received, total int64) {
+		publish, save := run.progress.update(link, received, total)
+		if !publish && !save {
+			return
+		}
+		progress := run.progress.snapshot()
+		if publish {
+			s.publish(run.task.ID, EventProgress, progress, false)
+		}
+		if !save {
+			return
+		}
+		err := run.update(ctx, func(task *model.Task) {
+			task.Progress = progress
+		})
+		if err != nil {
+			s.log.Errorf("during process task ID %s failed to save progress: %s", run.task.ID, err)
+		}
+	}
+}
+
+func linkDone(link string, d model.Download) LinkEvent {
+	return LinkEvent{URL: link, Size: d.Offset, ContentType: d.ContentType, SHA256: d.SHA256}
+}
+
+// nameEntries settles the entry names of the downloaded files. Names are
+// given out in the order of the links, so duplicates get the same suffixes
+// whatever order the downloads finished in.
+func (s *taskService) nameEntries(ctx context.Context, run *taskRun) []ArchiveFile {
+	var files []ArchiveFile
+	run.update(ctx, func(task *model.Task) {
+		downloaded := make(map[string]struct{}, len(task.DownloadedFiles))
+		for _, path := range task.DownloadedFiles {
+			downloaded[path] = struct{}{}
+		}
+		for _, link := range task.Links {
+			d, ok := task.Downloads[link]
+			if !ok || !d.Done {
+				continue
+			}
+			if _, ok := downloaded[d.Path]; !ok {
+				continue
+			}
+			if d.Entry == "" {
+				d.Entry = entryName(task.Names[link], "", link, "")
+			}
+			d.Entry = run.names.reserve(d.Entry)
+			files = append(files, ArchiveFile{Path: d.Path, Name: d.Entry})
+		}
+	})
+	return files
+}
+
+func (s *taskService) removeFiles(files []string) {
+	for _, f := range files {
+		if err := os.Remove(f); err != nil && !errors.Is(err, os.ErrNotExist) {
+			s.log.Errorf("failed to remove file %s: %s", f, err)
+		}
+	}
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func fileName(link string) string {
+	ext := ""
+	if u, err := url.Parse(link); err == nil {
+		ext = filepath.Ext(u.Path)
+	}
+	return uuid.NewString() + ext
+}
@@ -0,0 +1,160 @@
+package services
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/DeneesK/file-downloader/internal/app/model"
+)
+
+const (
+	// rateWindow is how often the throughput of a link is sampled.
+	rateWindow = 500 * time.Millisecond
+	// rateSmoothing is the weight of the latest sample in the moving
+	// average of the throughput.
+	rateSmoothing = 0.3
+	// staleAfter is how long a link may go without data before its
+	// throughput is reported as zero.
+	staleAfter = 3 * time.Second
+	// progressEventInterval is how often progress events are published.
+	progressEventInterval = time.Second
+)
+
+type linkMeter struct {
+	received int64
+	total    int64
+	done     bool
+
+	rate        float64
+	sampleAt    time.Time
+	sampleBytes int64
+	updatedAt   time.Time
+}
+
+func (m *linkMeter) update(received, total int64, now time.Time) {
+	switch {
+	case m.sampleAt.IsZero() || received < m.sampleBytes:
+		m.sampleAt, m.sampleBytes = now, received
+	case now.Sub(m.sampleAt) >= rateWindow:
+		rate := float64(received-m.sampleBytes) / now.Sub(m.sampleAt).Seconds()
+		if m.rate == 0 {
+			m.rate = rate
+		} else {
+			m.rate = rateSmoothing*rate + (1-rateSmoothing)*m.rate
+		}
+		m.sampleAt, m.sampleBytes = now, received
+	}
+	m.received, m.total, m.updatedAt = received, total, now
+}
+
+// progressTracker collects the progress of the links of a running task. It
+// lives in memory and is read by GetTask; the stored task gets a snapshot at
+// most once per interval, so that fast downloads don't turn into a stream of
+// storage writes.
+type progressTracker struct {
+	mu          sync.Mutex
+	links       map[string]*linkMeter
+	interval    time.Duration
+	savedAt     time.Time
+	publishedAt time.Time
+}
+
+// newProgressTracker starts tracking the links of the task that are still
+// to be fetched, counting what earlier runs have already downloaded.
+func newProgressTracker(task model.Task, interval time.Duration) *progressTracker {
+	p := &progressTracker{
+		links:    make(map[string]*linkMeter, len(task.Links)),
+		interval: interval,
+		savedAt:  time.Now(),
+	}
+	for _, link := range task.Links {
+		if _, failed := task.FailedLinks[link]; failed {
+			continue
+		}
+		m := &linkMeter{}
+		if d, ok := task.Downloads[link]; ok {
+			m.received, m.total, m.done = d.Offset, max(d.Size, 0), d.Done
+		}
+		p.links[link] = m
+	}
+	return p
+}
+
+// update records the progress of a link and reports whether it is time to
+// publish and to save a snapshot.
+func (p *progressTracker) update(link string, received, total int64) (publish, save bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	m, ok := p.links[link]
+	if !ok {
+		m = &linkMeter{}
+		p.links[link] = m
+	}
+	m.update(received, max(total, 0), now)
+	if now.Sub(p.publishedAt) >= progressEventInterval {
+		p.publishedAt, publish = now, true
+	}
+	if now.Sub(p.savedAt) >= p.interval {
+		p.savedAt, save = now, true
+	}
+	return publish, save
+}
+
+func (p *progressTracker) finish(link string, size int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.links[link] = &linkMeter{received: size, total: size, done: true}
+}
+
+// drop stops tracking a link that failed, so it doesn't hold back the
+// progress of the task.
+func (p *progressTracker) drop(link string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.links, link)
+}
+
+func (p *progressTracker) snapshot() *model.TaskProgress {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	tp := &model.TaskProgress{Links: make(map[string]model.Progress, len(p.links)), UpdatedAt: now}
+	totalKnown := true
+	for link, m := range p.links {
+		lp := model.Progress{Received: m.received, Total: m.total, Done: m.done}
+		if !m.done && now.Sub(m.updatedAt) < staleAfter {
+			lp.Throughput = math.Round(m.rate)
+		}
+		fillEstimates(&lp)
+		tp.Links[link] = lp
+
+		tp.Received += lp.Received
+		tp.Total += lp.Total
+		tp.Throughput += lp.Throughput
+		totalKnown = totalKnown && (m.total > 0 || m.done)
+	}
+	if !totalKnown {
+		tp.Total = 0
+	}
+	tp.Done = len(p.links) > 0
+	for _, lp := range tp.Links {
+		tp.Done = tp.Done && lp.Done
+	}
+	fillEstimates(&tp.Progress)
+	return tp
+}
+
+// fillEstimates sets the percentage and the ETA where the total is known.
+func fillEstimates(p *model.Progress) {
+	if p.Total <= 0 {
+		return
+	}
+	p.Percent = math.Round(float64(p.Received)/float64(p.Total)*1000) / 10
+	if p.Throughput > 0 && p.Received < p.Total {
+		p.ETA = int64(math.Ceil(float64(p.Total-p.Received) / p.Throughput))
+	}
+}
@@ -0,0 +1,83 @@
+package services
+
+import (
+	"context"
+	"os"
+
+	"github.com/DeneesK/file-downloader/internal/app/model"
+)
+
+// Recover puts back to work the tasks that were not finished when the
+// process stopped. It must be called once on startup, before any task is
+// created. Tasks that were queued or being processed are queued again;
+// downloads that were complete are kept, and half-written files are cut back
+// to the last saved offset or removed.
+func (s *taskService) Recover(ctx context.Context) error {
+	tasks, err := s.taskStore.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, task := range tasks {
+		if task.IsTerminal() {
+			continue
+		}
+
+		s.m.Lock()
+		s.activeTasks++
+		s.m.Unlock()
+
+		if task.Status == model.StatusCreated || task.Status == model.StatusCollecting {
+			continue
+		}
+
+		if task.Status != model.StatusQueued {
+			if err := task.SetStatus(model.StatusQueued); err != nil {
+				s.log.Errorf("failed to recover task ID %s: %s", task.ID, err)
+				continue
+			}
+		}
+		task.DownloadedFiles = task.DownloadedFiles[:0]
+		for _, l := range task.Links {
+			d, ok := task.Downloads[l]
+			if !ok {
+				continue
+			}
+			s.recoverDownload(d)
+			if d.Done {
+				task.DownloadedFiles = append(task.DownloadedFiles, d.Path)
+			}
+		}
+		if err := s.taskStore.Update(ctx, task); err != nil {
+			s.log.Errorf("failed to recover task ID %s: %s", task.ID, err)
+			continue
+		}
+
+		s.log.Infoln("recovered task ID", task.ID)
+		s.enqueue(task.ID)
+	}
+	return nil
+}
+
+// recoverDownload makes the file on disk match the saved progress. Bytes
+// written after the last saved offset are dropped; a partial file that can't
+// be resumed safely is removed so the link is downloaded from scratch.
+func (s *taskService) recoverDownload(d *model.Download) {
+	fi, err := os.Stat(d.Path)
+	if err != nil {
+		*d = model.Download{Path: d.Path}
+		return
+	}
+
+	switch {
+	case d.Done && fi.Size() == d.Offset:
+		return
+	case !d.Done && fi.Size() >= d.Offset && (d.ETag != "" || d.LastModified != ""):
+		if err := os.Truncate(d.Path, d.Offset); err == nil {
+			return
+		}
+	}
+
+	s.removeFiles([]string{d.Path})
+	*d = model.Download{Path: d.Path}
+}
@@ -0,0 +1,78 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/DeneesK/file-downloader/pkg/downloader"
+	"github.com/DeneesK/file-downloader/pkg/netguard"
+	"github.com/DeneesK/file-downloader/pkg/validator"
+)
+
+// RetryPolicy describes how failed link downloads are retried. The delay
+// grows exponentially from BaseDelay up to MaxDelay, and Jitter (0..1) is the
+// fraction of the delay that is randomised.
+type RetryPolicy struct {
+	MaxAttempts       int
+	BaseDelay         time.Duration
+	MaxDelay          time.Duration
+	Jitter            float64
+	RetryableStatuses []int
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:       3,
+	BaseDelay:         500 * time.Millisecond,
+	MaxDelay:          30 * time.Second,
+	Jitter:            0.2,
+	RetryableStatuses: []int{429, 502, 503, 504},
+}
+
+func (p RetryPolicy) retryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, validator.ErrNotValidURL) || errors.Is(err, ErrContentMismatch) || errors.Is(err, downloader.ErrTooLarge) || errors.Is(err, netguard.ErrBlocked) {
+		return false
+	}
+	var statusErr *downloader.StatusError
+	if errors.As(err, &statusErr) {
+		for _, code := range p.RetryableStatuses {
+			if statusErr.StatusCode == code {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// delay returns the pause before the next attempt. A Retry-After sent by the
+// server takes precedence but is still capped by MaxDelay.
+func (p RetryPolicy) delay(attempt int, err error) time.Duration {
+	var statusErr *downloader.StatusError
+	if errors.As(err, &statusErr) && statusErr.RetryAfter > 0 {
+		return min(statusErr.RetryAfter, p.MaxDelay)
+	}
+
+	d := p.BaseDelay
+	for i := 1; i < attempt && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	d = min(d, p.MaxDelay)
+
+	if p.Jitter > 0 {
+		d -= time.Duration(p.Jitter * rand.Float64() * float64(d))
+	}
+	return d
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
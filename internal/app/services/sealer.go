@@ -0,0 +1,53 @@
+package services
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+)
+
+var ErrPasswordUnavailable = errors.New("archive password can't be recovered, was PASSWORD_KEY changed?")
+
+// passwordSealer encrypts archive passwords with AES-GCM, so that tasks keep
+// only the sealed form until the archive is written.
+type passwordSealer struct {
+	aead cipher.AEAD
+}
+
+func newPasswordSealer(key []byte) passwordSealer {
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		rand.Read(key)
+	}
+	sum := sha256.Sum256(key)
+	block, _ := aes.NewCipher(sum[:])
+	aead, _ := cipher.NewGCM(block)
+	return passwordSealer{aead: aead}
+}
+
+func (s passwordSealer) seal(taskID, password string) []byte {
+	nonce := make([]byte, s.aead.NonceSize())
+	rand.Read(nonce)
+	return s.aead.Seal(nonce, nonce, []byte(password), []byte(taskID))
+}
+
+func (s passwordSealer) open(taskID string, sealed []byte) (string, error) {
+	if len(sealed) < s.aead.NonceSize() {
+		return "", ErrPasswordUnavailable
+	}
+	nonce, ciphertext := sealed[:s.aead.NonceSize()], sealed[s.aead.NonceSize():]
+	password, err := s.aead.Open(nil, nonce, ciphertext, []byte(taskID))
+	if err != nil {
+		return "", ErrPasswordUnavailable
+	}
+	return string(password), nil
+}
+
+func generatePassword() string {
+	b := make([]byte, 18)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
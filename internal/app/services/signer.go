@@ -0,0 +1,54 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"time"
+)
+
+var ErrLinkExpired = errors.New("archive link expired")
+var ErrBadSignature = errors.New("archive link signature is not valid")
+
+// urlSigner signs archive links with HMAC-SHA256 over the task ID and the
+// expiry time, so that a link can't be reused for another task or extended.
+type urlSigner struct {
+	key []byte
+	ttl time.Duration
+}
+
+func newURLSigner(key []byte, ttl time.Duration) urlSigner {
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		rand.Read(key)
+	}
+	return urlSigner{key: key, ttl: ttl}
+}
+
+func (s urlSigner) sign(taskID string, expires time.Time) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(taskID + "\n" + strconv.FormatInt(expires.Unix(), 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s urlSigner) verify(taskID, expires, signature string) error {
+	exp, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return ErrBadSignature
+	}
+	got, err := hex.DecodeString(signature)
+	if err != nil {
+		return ErrBadSignature
+	}
+	want, _ := hex.DecodeString(s.sign(taskID, time.Unix(exp, 0)))
+	if !hmac.Equal(got, want) {
+		return ErrBadSignature
+	}
+	if time.Now().Unix() > exp {
+		return ErrLinkExpired
+	}
+	return nil
+}
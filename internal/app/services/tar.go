@@ -0,0 +1,201 @@
+package services
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/klauspost/compress/zstd"
+)
+
+type tarService struct {
+	archiveDir string
+	format     Format
+}
+
+// NewTarService returns an archiver writing tarballs, compressed according
+// to the format: FormatTar, FormatTarGz or FormatTarZst.
+func NewTarService(archiveDir string, format Format) *tarService {
+	os.MkdirAll(archiveDir, filePerm)
+	return &tarService{archiveDir: archiveDir, format: format}
+}
+
+// CreateArchive packs the files that can be opened. A failed write fails
+// the whole archive, which is removed then.
+func (s *tarService) CreateArchive(files []ArchiveFile, opts ArchiveOptions) (string, error) {
+	stream, err := s.open(opts)
+	if err != nil {
+		return "", err
+	}
+
+	for _, file := range files {
+		f, err := os.Open(file.Path)
+		if err != nil {
+			continue
+		}
+		err = stream.addFile(file.Name, f)
+		f.Close()
+		if err != nil {
+			stream.Abort()
+			return "", err
+		}
+	}
+
+	return stream.Close()
+}
+
+// NewStream starts a tarball fed as the data arrives. A tar header carries
+// the size of the entry, so each entry is spooled to a temporary file and
+// appended once it is complete.
+func (s *tarService) NewStream(opts ArchiveOptions) (ArchiveStream, error) {
+	return s.open(opts)
+}
+
+// open starts a tarball. The compression method of opts doesn't apply to
+// tarballs, only the level does.
+func (s *tarService) open(opts ArchiveOptions) (*tarStream, error) {
+	archiveName := filepath.Join(s.archiveDir, uuid.NewString()+s.format.Ext)
+	out, err := os.Create(archiveName)
+	if err != nil {
+		return nil, err
+	}
+
+	var compressed io.WriteCloser
+	switch s.format.Name {
+	case FormatTarGz.Name:
+		level := gzip.DefaultCompression
+		if opts.Level > 0 {
+			level = opts.Level
+		}
+		compressed, err = gzip.NewWriterLevel(out, level)
+	case FormatTarZst.Name:
+		level := zstd.SpeedDefault
+		if opts.Level > 0 {
+			level = zstd.EncoderLevelFromZstd(opts.Level)
+		}
+		compressed, err = zstd.NewWriter(out, zstd.WithEncoderLevel(level))
+	default:
+		compressed = nopWriteCloser{out}
+	}
+	if err != nil {
+		out.Close()
+		os.Remove(archiveName)
+		return nil, err
+	}
+
+	return &tarStream{
+		path:       archiveName,
+		out:        out,
+		compressed: compressed,
+		w:          tar.NewWriter(compressed),
+	}, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+type tarStream struct {
+	path       string
+	out        *os.File
+	compressed io.WriteCloser
+	w          *tar.Writer
+
+	name  string
+	spool *os.File
+}
+
+func (t *tarStream) Create(name string) (io.Writer, error) {
+	if err := t.flush(); err != nil {
+		return nil, err
+	}
+	spool, err := os.CreateTemp(filepath.Dir(t.path), ".entry-*")
+	if err != nil {
+		return nil, err
+	}
+	t.name, t.spool = name, spool
+	return spool, nil
+}
+
+// Discard drops the entry being written.
+func (t *tarStream) Discard() {
+	if t.spool != nil {
+		t.spool.Close()
+		os.Remove(t.spool.Name())
+		t.spool = nil
+	}
+}
+
+func (t *tarStream) Close() (string, error) {
+	err := t.flush()
+	if cErr := t.w.Close(); err == nil {
+		err = cErr
+	}
+	if cErr := t.compressed.Close(); err == nil {
+		err = cErr
+	}
+	if cErr := t.out.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		t.Discard()
+		os.Remove(t.path)
+		return "", err
+	}
+	return t.path, nil
+}
+
+// Abort drops the archive altogether.
+func (t *tarStream) Abort() {
+	t.Discard()
+	t.w.Close()
+	t.compressed.Close()
+	t.out.Close()
+	os.Remove(t.path)
+}
+
+// flush appends the spooled entry to the archive.
+func (t *tarStream) flush() error {
+	if t.spool == nil {
+		return nil
+	}
+	defer t.Discard()
+
+	fi, err := t.spool.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := t.spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return t.append(t.name, fi.Size(), time.Now(), t.spool)
+}
+
+func (t *tarStream) addFile(name string, f *os.File) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return t.append(name, fi.Size(), fi.ModTime(), f)
+}
+
+func (t *tarStream) append(name string, size int64, modTime time.Time, r io.Reader) error {
+	err := t.w.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0644,
+		ModTime:  modTime,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(t.w, r, size)
+	return err
+}
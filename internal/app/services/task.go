@@ -4,36 +4,65 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"net/http"
 	"net/url"
+	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/DeneesK/file-downloader/internal/app/model"
 	"github.com/DeneesK/file-downloader/pkg/downloader"
+	"github.com/DeneesK/file-downloader/pkg/netguard"
+	"github.com/DeneesK/file-downloader/pkg/validator"
 	"github.com/google/uuid"
 )
 
 var ErrTooManyTasks = errors.New("server busy: too many active tasks")
 var ErrNotValidExaction = errors.New("not valid exaction")
 var ErrTooManyFiles = errors.New("too many files per task")
-
-var allowedExtensions = map[string]struct{}{
-	".pdf":  {},
-	".jpeg": {},
-	".jpg":  {},
-}
+var ErrTaskFrozen = errors.New("task is submitted, links can't be changed")
+var ErrNoLinks = errors.New("task has no links")
+var ErrTaskCanceled = errors.New("task canceled")
+var ErrArchiveNotReady = errors.New("archive is not ready")
+var ErrArchiveExpired = errors.New("archive expired and was removed")
+var ErrEncryptionUnsupported = errors.New("encryption is supported for zip archives only")
+var ErrBadEntryName = errors.New("not valid file name")
 
 type TaskStorage interface {
 	Store(ctx context.Context, task *model.Task) error
 	Get(ctx context.Context, id string) (model.Task, error)
 	Update(ctx context.Context, task model.Task) error
+	List(ctx context.Context) ([]model.Task, error)
 	Close(ctx context.Context) error
 	Ping(ctx context.Context) error
 }
 
-type ZipService interface {
-	CreateZipArchive(files []string) (string, error)
+// ArchiveFile is a file on disk to be put into an archive under Name.
+type ArchiveFile struct {
+	Path string
+	Name string
+}
+
+type Archiver interface {
+	CreateArchive(files []ArchiveFile, opts ArchiveOptions) (string, error)
+	NewStream(opts ArchiveOptions) (ArchiveStream, error)
+}
+
+type ArchiveStream interface {
+	Create(name string) (io.Writer, error)
+	Discard()
+	Close() (string, error)
+	Abort()
+}
+
+type Downloader interface {
+	Resume(ctx context.Context, url string, st *downloader.State) error
+	Stream(ctx context.Context, url string, st *downloader.State, open func(st *downloader.State) (io.Writer, error)) error
 }
 
 type Logger interface {
@@ -50,67 +79,366 @@ type taskService struct {
 	taskQueue   chan string
 	wg          sync.WaitGroup
 	m           sync.RWMutex
+	lifecycle   sync.Mutex
+	running     map[string]*runningTask
 	taskStore   TaskStorage
-	zip         ZipService
+	archivers   *Archivers
+	compression ArchiveOptions
+	manifest    bool
 	log         Logger
+	retry       RetryPolicy
+	downloader  Downloader
+	streaming   bool
+	downloadDir string
+	fileTypes   []FileType
+	guard       *netguard.Guard
+
+	maxFileBytes int64
+	maxTaskBytes int64
+	diskDir      string
+	minFreeSpace int64
+
+	baseURL string
+	signer  urlSigner
+	sealer  passwordSealer
+	events  *eventHub
+
+	webhooks       WebhookConfig
+	callbacks      chan struct{}
+	callbackQueue  *callbackQueue
+	httpClient     *http.Client
+	callbackClient *http.Client
+
+	workers          int
+	linkWorkers      int
+	shutdownTimeout  time.Duration
+	progressInterval time.Duration
+}
+
+type Option func(*taskService)
+
+// WithStreaming makes the service pipe downloads straight into the archive
+// instead of keeping them in temporary files.
+func WithStreaming(streaming bool) Option {
+	return func(s *taskService) {
+		s.streaming = streaming
+	}
+}
+
+// WithWorkers sets the number of tasks processed concurrently and the number
+// of links downloaded concurrently within one task.
+func WithWorkers(workers, linkWorkers int) Option {
+	return func(s *taskService) {
+		s.workers = max(workers, 1)
+		s.linkWorkers = max(linkWorkers, 1)
+	}
+}
+
+func WithShutdownTimeout(d time.Duration) Option {
+	return func(s *taskService) {
+		s.shutdownTimeout = d
+	}
+}
+
+// WithBaseURL sets the public address used to build archive download links.
+func WithBaseURL(baseURL string) Option {
+	return func(s *taskService) {
+		s.baseURL = strings.TrimSuffix(baseURL, "/")
+	}
 }
 
-func NewTaskService(store TaskStorage, log Logger, tasksLimit, linksLimit int, zip ZipService) *taskService {
-	return &taskService{
-		activeTasks: 0,
-		taskStore:   store,
-		log:         log,
-		tasksLimit:  tasksLimit,
-		linksLimit:  linksLimit,
-		zip:         zip,
-		taskQueue:   make(chan string, tasksLimit),
+// WithLinkSigning sets the key used to sign archive links and how long the
+// links stay valid. Without a key a random one is generated on start, so the
+// links don't survive a restart.
+func WithLinkSigning(key []byte, ttl time.Duration) Option {
+	return func(s *taskService) {
+		s.signer = newURLSigner(key, ttl)
 	}
 }
 
-func (s *taskService) CreateTask(ctx context.Context) (string, error) {
+// WithCompression sets the compression used for tasks that don't choose
+// their own.
+func WithCompression(opts ArchiveOptions) Option {
+	return func(s *taskService) {
+		s.compression = opts
+	}
+}
+
+// WithManifest makes archives include manifest.json and SHA256SUMS unless a
+// task opts out.
+func WithManifest(manifest bool) Option {
+	return func(s *taskService) {
+		s.manifest = manifest
+	}
+}
+
+// WithPasswordKey sets the key archive passwords are sealed with while their
+// tasks wait to be archived.
+func WithPasswordKey(key []byte) Option {
+	return func(s *taskService) {
+		s.sealer = newPasswordSealer(key)
+	}
+}
+
+// WithProgressInterval sets how often the progress of running tasks is saved
+// to the storage. GetTask always reports the live progress.
+func WithProgressInterval(interval time.Duration) Option {
+	return func(s *taskService) {
+		s.progressInterval = interval
+	}
+}
+
+// WithDownloadDir sets the dir for files being downloaded.
+func WithDownloadDir(dir string) Option {
+	return func(s *taskService) {
+		s.downloadDir = dir
+	}
+}
+
+// WithNetGuard rejects links and callback URLs that point to blocked hosts
+// as soon as they are added and, unless WithHTTPClient is given, makes
+// callbacks through connections g allows. Downloads are guarded by the
+// client of the downloader.
+func WithNetGuard(g *netguard.Guard) Option {
+	return func(s *taskService) {
+		s.guard = g
+	}
+}
+
+// WithHTTPClient sets the client whose transport callbacks are sent
+// through, usually the one of the downloader.
+func WithHTTPClient(c *http.Client) Option {
+	return func(s *taskService) {
+		s.httpClient = c
+	}
+}
+
+func WithDownloader(d Downloader) Option {
+	return func(s *taskService) {
+		s.downloader = d
+	}
+}
+
+func WithRetryPolicy(p RetryPolicy) Option {
+	return func(s *taskService) {
+		s.retry = p
+	}
+}
+
+func NewTaskService(store TaskStorage, log Logger, tasksLimit, linksLimit int, archivers *Archivers, opts ...Option) *taskService {
+	s := &taskService{
+		activeTasks:   0,
+		taskStore:     store,
+		log:           log,
+		tasksLimit:    tasksLimit,
+		linksLimit:    linksLimit,
+		archivers:     archivers,
+		compression:   ArchiveOptions{Compression: CompressionAuto},
+		taskQueue:     make(chan string, tasksLimit),
+		running:       make(map[string]*runningTask),
+		signer:        newURLSigner(nil, 24*time.Hour),
+		sealer:        newPasswordSealer(nil),
+		events:        newEventHub(),
+		webhooks:      DefaultWebhookConfig,
+		callbacks:     make(chan struct{}, 1),
+		callbackQueue: newCallbackQueue(),
+		downloadDir:   os.TempDir(),
+		fileTypes:     defaultFileTypes,
+		retry:         DefaultRetryPolicy,
+		downloader:    downloader.New(downloader.Config{}),
+
+		workers:          max(tasksLimit, 1),
+		linkWorkers:      1,
+		shutdownTimeout:  30 * time.Second,
+		progressInterval: 5 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.callbackClient = s.newCallbackClient()
+	os.MkdirAll(s.downloadDir, filePerm)
+	return s
+}
+
+// CreateTask creates a task with the options chosen by the client. If the
+// archive is to be encrypted with a generated password, the returned task
+// carries it; the stored task keeps it sealed only.
+func (s *taskService) CreateTask(ctx context.Context, opts model.TaskOptions) (*model.Task, error) {
+	format, _, err := s.archivers.Get(opts.Format)
+	if err != nil {
+		return nil, err
+	}
+	opts.Format = format.Name
+	if err := s.archiveOptions(opts).Validate(); err != nil {
+		return nil, err
+	}
+	if err := s.validateCallbackURL(opts.CallbackURL); err != nil {
+		return nil, err
+	}
+	if err := s.checkDiskSpace(); err != nil {
+		return nil, err
+	}
+	password := opts.Password
+	opts.Password = ""
+	if password != "" {
+		opts.Encrypt = true
+	}
+	if opts.Encrypt && format != FormatZip {
+		return nil, ErrEncryptionUnsupported
+	}
+
 	s.m.Lock()
 	if s.activeTasks >= s.tasksLimit {
-		return "", ErrTooManyTasks
+		s.m.Unlock()
+		return nil, ErrTooManyTasks
 	}
 	s.activeTasks++
 	s.m.Unlock()
 
 	id := uuid.NewString()
 
-	task := &model.Task{ID: id, Status: model.StatusCreated, Links: make([]string, 0, 3), FailedLinks: make(map[string]string, 0)}
-	err := s.taskStore.Store(ctx, task)
+	task := &model.Task{
+		ID:          id,
+		Status:      model.StatusCreated,
+		TaskOptions: opts,
+		Links:       make([]string, 0, 3),
+		FailedLinks: make(map[string]string, 0),
+		Downloads:   make(map[string]*model.Download, 0),
+		Attempts:    make(map[string][]model.Attempt, 0),
+	}
+	generated := false
+	if opts.Encrypt {
+		if password == "" {
+			password, generated = generatePassword(), true
+		}
+		task.SealedPassword = s.sealer.seal(id, password)
+	}
+	err = s.taskStore.Store(ctx, task)
 	if err != nil {
-		return "", err
+		s.decrementActiveTasks()
+		return nil, err
 	}
 
-	go func() {
-		s.taskQueue <- task.ID
-	}()
-
-	return id, nil
+	if generated {
+		task.Password = password
+	}
+	return task, nil
 }
 
 func (s *taskService) AddLinks(ctx context.Context, taskID string, links []string) error {
+	return s.AddNamedLinks(ctx, taskID, links, nil)
+}
+
+// AddNamedLinks adds links to the task, naming the archive entries of those
+// found in names as the client asked.
+func (s *taskService) AddNamedLinks(ctx context.Context, taskID string, links []string, names map[string]string) error {
 	if len(links) > s.linksLimit {
 		return ErrTooManyFiles
 	}
-	if !(s.isAllowedExtension(links)) {
-		return ErrNotValidExaction
+	if err := s.checkLinks(links); err != nil {
+		return err
 	}
+	sanitized := make(map[string]string, len(names))
+	for link, name := range names {
+		if !slices.Contains(links, link) {
+			return fmt.Errorf("%w: %q is given for a link that is not added", ErrBadEntryName, name)
+		}
+		if sanitized[link] = sanitizeName(name); sanitized[link] == "" {
+			return fmt.Errorf("%w: %q", ErrBadEntryName, name)
+		}
+	}
+
+	s.lifecycle.Lock()
+	defer s.lifecycle.Unlock()
 
 	task, err := s.taskStore.Get(ctx, taskID)
 	if err != nil {
 		return err
 	}
 
-	if task.LinksNumber >= s.linksLimit {
+	if task.Status != model.StatusCreated && task.Status != model.StatusCollecting {
+		return ErrTaskFrozen
+	}
+	if len(task.Links)+len(links) > s.linksLimit {
 		return ErrTooManyFiles
 	}
 
 	task.Links = append(task.Links, links...)
-	task.LinksNumber++
+	task.LinksNumber = len(task.Links)
+	if len(sanitized) > 0 && task.Names == nil {
+		task.Names = make(map[string]string, len(sanitized))
+	}
+	for link, name := range sanitized {
+		task.Names[link] = name
+	}
+	collecting := task.Status == model.StatusCreated
+	if collecting {
+		task.Status = model.StatusCollecting
+	}
 
-	return s.taskStore.Update(ctx, task)
+	if err := s.taskStore.Update(ctx, task); err != nil {
+		return err
+	}
+	if collecting {
+		s.statusChanged(task)
+	}
+	return nil
+}
+
+// SubmitTask freezes the links of the task and queues it for processing.
+func (s *taskService) SubmitTask(ctx context.Context, taskID string) error {
+	s.lifecycle.Lock()
+	defer s.lifecycle.Unlock()
+
+	task, err := s.taskStore.Get(ctx, taskID)
+	if err != nil {
+		return err
+	}
+	if len(task.Links) == 0 {
+		return ErrNoLinks
+	}
+	if err := task.SetStatus(model.StatusQueued); err != nil {
+		return err
+	}
+	if err := s.taskStore.Update(ctx, task); err != nil {
+		return err
+	}
+	s.statusChanged(task)
+
+	s.enqueue(taskID)
+	return nil
+}
+
+// CancelTask stops the task. A task that is being processed is interrupted
+// and CancelTask waits until its downloads are aborted and files removed.
+func (s *taskService) CancelTask(ctx context.Context, taskID string) error {
+	s.lifecycle.Lock()
+	if rt, ok := s.running[taskID]; ok {
+		s.lifecycle.Unlock()
+		rt.cancel(ErrTaskCanceled)
+		select {
+		case <-rt.done:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	defer s.lifecycle.Unlock()
+
+	task, err := s.taskStore.Get(ctx, taskID)
+	if err != nil {
+		return err
+	}
+	if err := task.SetStatus(model.StatusCanceled); err != nil {
+		return err
+	}
+	if err := s.taskStore.Update(ctx, task); err != nil {
+		return err
+	}
+	s.statusChanged(task)
+
+	s.decrementActiveTasks()
+	return nil
 }
 
 func (s *taskService) GetTask(ctx context.Context, taskID string) (*model.Task, error) {
@@ -118,24 +446,197 @@ func (s *taskService) GetTask(ctx context.Context, taskID string) (*model.Task,
 	if err != nil {
 		return nil, err
 	}
+	s.withArchiveLink(&task)
+
+	s.lifecycle.Lock()
+	rt, running := s.running[taskID]
+	s.lifecycle.Unlock()
+	if running {
+		task.Progress = rt.progress.snapshot()
+	}
 	return &task, nil
 }
 
+// ArchiveLink mints a fresh signed link to the archive of a finished task.
+func (s *taskService) ArchiveLink(ctx context.Context, taskID string) (*model.ArchiveLink, error) {
+	task, err := s.taskStore.Get(ctx, taskID)
+	if err != nil {
+		return nil, err
+	}
+	if task.Status != model.StatusDone {
+		return nil, ErrArchiveNotReady
+	}
+	link := s.archiveLink(taskID)
+	return &link, nil
+}
+
+// VerifyArchiveLink checks the expiry and signature taken from an archive link.
+func (s *taskService) VerifyArchiveLink(taskID, expires, signature string) error {
+	return s.signer.verify(taskID, expires, signature)
+}
+
+// Archive is an opened archive of a finished task.
+type Archive struct {
+	Name        string
+	ContentType string
+	ModTime     time.Time
+	Size        int64
+	Content     io.ReadSeekCloser
+}
+
+func (s *taskService) OpenArchive(ctx context.Context, taskID string) (*Archive, error) {
+	task, err := s.taskStore.Get(ctx, taskID)
+	if err != nil {
+		return nil, err
+	}
+	if task.Status == model.StatusExpired {
+		return nil, ErrArchiveExpired
+	}
+	if task.Status != model.StatusDone || task.Archive == "" {
+		return nil, ErrArchiveNotReady
+	}
+
+	format, _, err := s.archivers.Get(task.Format)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(task.Archive)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if err := s.touchArchive(ctx, taskID); err != nil {
+		s.log.Errorf("failed to save archive access of task ID %s: %s", taskID, err)
+	}
+
+	return &Archive{
+		Name:        task.ID + format.Ext,
+		ContentType: format.ContentType,
+		ModTime:     fi.ModTime(),
+		Size:        fi.Size(),
+		Content:     f,
+	}, nil
+}
+
+// touchArchive records that the archive of the task was accessed, so that
+// the janitor evicts it later.
+func (s *taskService) touchArchive(ctx context.Context, taskID string) error {
+	s.lifecycle.Lock()
+	defer s.lifecycle.Unlock()
+
+	task, err := s.taskStore.Get(ctx, taskID)
+	if err != nil {
+		return err
+	}
+	if task.Status != model.StatusDone {
+		return nil
+	}
+	task.LastAccessAt = time.Now()
+	return s.taskStore.Update(ctx, task)
+}
+
+// archiveOptions merges the compression settings of a task over the
+// service-wide ones.
+func (s *taskService) archiveOptions(opts model.TaskOptions) ArchiveOptions {
+	archiveOpts := s.compression
+	if opts.Compression != "" {
+		archiveOpts.Compression = opts.Compression
+	}
+	if opts.CompressionLevel != 0 {
+		archiveOpts.Level = opts.CompressionLevel
+	}
+	return archiveOpts
+}
+
+// taskArchiveOptions returns the archive options of the task with its
+// password unsealed.
+func (s *taskService) taskArchiveOptions(task model.Task) (ArchiveOptions, error) {
+	opts := s.archiveOptions(task.TaskOptions)
+	if !task.Encrypt {
+		return opts, nil
+	}
+	password, err := s.sealer.open(task.ID, task.SealedPassword)
+	if err != nil {
+		return opts, err
+	}
+	opts.Password = password
+	return opts, nil
+}
+
+func (s *taskService) archiveLink(taskID string) model.ArchiveLink {
+	expires := time.Now().Add(s.signer.ttl).Truncate(time.Second)
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	query.Set("signature", s.signer.sign(taskID, expires))
+	return model.ArchiveLink{
+		URL:       s.baseURL + "/task/" + taskID + "/archive?" + query.Encode(),
+		ExpiresAt: expires,
+	}
+}
+
+// withArchiveLink gives a finished task a fresh link to its archive.
+func (s *taskService) withArchiveLink(task *model.Task) {
+	if task.Status == model.StatusDone {
+		link := s.archiveLink(task.ID)
+		task.ArchiveURL = link.URL
+		task.ArchiveExpiresAt = &link.ExpiresAt
+	}
+}
+
+// Start runs the worker pool until ctx is canceled. On shutdown it waits for
+// in-flight tasks for up to the shutdown timeout, then interrupts them; the
+// interrupted tasks keep their download progress in the storage.
 func (s *taskService) Start(ctx context.Context) {
-	s.log.Infoln("task service started")
+	s.log.Infoln("task service started with", s.workers, "workers")
+
+	workCtx, cancelWork := context.WithCancel(context.Background())
+	defer cancelWork()
 
+	for range s.workers {
+		s.wg.Add(1)
+		go s.worker(ctx, workCtx)
+	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.deliverCallbacks(ctx)
+	}()
+
+	<-ctx.Done()
+	s.log.Infoln("task service try to gracefully shutdown")
+	s.events.close()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(s.shutdownTimeout):
+		s.log.Infoln("task service shutdown timeout exceeded, checkpointing in-flight tasks")
+		cancelWork()
+		<-done
+	}
+
+	s.log.Infoln("task service gracefully shutdown")
+}
+
+func (s *taskService) worker(ctx, workCtx context.Context) {
+	defer s.wg.Done()
 	for {
 		select {
 		case <-ctx.Done():
-			s.log.Infoln("task service try to gracefully shutdown")
-
-			s.wg.Wait()
-
-			s.log.Infoln("task service gracefully shutdown")
 			return
-		case task := <-s.taskQueue:
-			s.wg.Add(1)
-			s.processTask(ctx, task)
+		case taskID := <-s.taskQueue:
+			s.processTask(workCtx, taskID)
 		}
 	}
 }
@@ -153,83 +654,44 @@ func (s *taskService) decrementActiveTasks() {
 	s.m.Unlock()
 }
 
-func (s *taskService) setStatus(ctx context.Context, taskID string, status string) error {
-	task, err := s.taskStore.Get(ctx, taskID)
-	if err != nil {
-		return err
-	}
-	task.Status = status
-
-	return s.taskStore.Update(ctx, task)
+func (s *taskService) enqueue(taskID string) {
+	go func() {
+		s.taskQueue <- taskID
+	}()
 }
 
-func (s *taskService) processTask(ctx context.Context, taskID string) {
-	defer s.decrementActiveTasks()
-	defer s.wg.Done()
-	s.log.Infoln("started process of task ID ", taskID)
-	s.setStatus(ctx, taskID, model.StatusRunning)
-
-	for {
-		select {
-		case <-ctx.Done():
-			s.log.Infoln("task canceled:", taskID)
-			return
-		default:
-			task, err := s.taskStore.Get(ctx, taskID)
-			if err != nil {
-				s.log.Errorf("during process of task ID %s error %v", taskID, err)
-			}
-
-			if len(task.FailedLinks) == s.linksLimit {
-				task.Status = model.StatusFailed
-				s.taskStore.Update(ctx, task)
-				return
-			} else if len(task.FailedLinks)+len(task.DownloadedFiles) == s.linksLimit {
-				archive, err := s.zip.CreateZipArchive(task.DownloadedFiles)
-				if err != nil {
-					s.log.Errorf("during process of task ID %s error %v", taskID, err)
-					task.Status = model.StatusFailed
-					s.taskStore.Update(ctx, task)
-					return
-				}
-				task.Archive = archive
-				task.Status = model.StatusDone
-				s.taskStore.Update(ctx, task)
-				return
-			}
-
-			for _, l := range task.Links {
-				filepath, err := downloader.DownloadFile(l)
-				if err != nil {
-					s.log.Errorf("during process task ID %s failed to download file %v", taskID, err)
-					task.FailedLinks[l] = fmt.Sprintf("%s", err)
-					s.taskStore.Update(context.Background(), task)
-				}
-				task.DownloadedFiles = append(task.DownloadedFiles, filepath)
-				task.Links = task.Links[:0]
-				err = s.taskStore.Update(context.Background(), task)
-				if err != nil {
-					s.log.Errorf("during process task ID %s error %s", taskID, err)
-					s.setStatus(context.Background(), taskID, model.StatusFailed)
-					return
-				}
-			}
+// checkLinks returns a RejectedLinksError unless every link has the
+// extension of an allowed type or no extension at all, in which case only
+// the content of the download can tell.
+func (s *taskService) checkLinks(links []string) error {
+	rejected := make(map[string]string)
+	for _, link := range links {
+		u, err := url.Parse(link)
+		if err != nil || !validator.IsValidURL(link) {
+			rejected[link] = "not a valid url"
+			continue
 		}
-	}
-}
-
-func (s *taskService) isAllowedExtension(links []string) bool {
-	for _, l := range links {
-		u, err := url.Parse(l)
-		if err != nil {
-			return false
+		if s.guard != nil {
+			if err := s.guard.CheckURL(link); err != nil {
+				rejected[link] = err.Error()
+				continue
+			}
 		}
 		ext := strings.ToLower(filepath.Ext(u.Path))
-		_, ok := allowedExtensions[ext]
-		if !ok {
-			return false
+		if ext != "" && !slices.ContainsFunc(s.fileTypes, func(t FileType) bool { return slices.Contains(t.Extensions, ext) }) {
+			rejected[link] = fmt.Sprintf("extension %s is not allowed, allowed are %s", ext, s.allowedExtensions())
 		}
 	}
+	if len(rejected) > 0 {
+		return &RejectedLinksError{Links: rejected}
+	}
+	return nil
+}
 
-	return true
+func (s *taskService) allowedExtensions() string {
+	var exts []string
+	for _, t := range s.fileTypes {
+		exts = append(exts, t.Extensions...)
+	}
+	return strings.Join(exts, ", ") + " or none"
 }
@@ -0,0 +1,335 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/DeneesK/file-downloader/internal/app/model"
+	"github.com/DeneesK/file-downloader/pkg/netguard"
+)
+
+var ErrBadCallbackURL = errors.New("callback url must be an absolute http or https url")
+var ErrCallbacksDisabled = errors.New("callbacks are disabled: webhook secret is not set")
+
+const (
+	// SignatureHeader carries "sha256=" and the hex HMAC-SHA256 of the
+	// timestamp, a dot and the body, keyed with the webhook secret.
+	SignatureHeader = "X-Webhook-Signature"
+	// TimestampHeader is the Unix time the callback was signed at, so that
+	// receivers can reject replays.
+	TimestampHeader = "X-Webhook-Timestamp"
+)
+
+// WebhookConfig sets how task callbacks are delivered. Without a secret no
+// callbacks are sent, as they could not be signed.
+type WebhookConfig struct {
+	Secret  []byte
+	Timeout time.Duration
+	Retry   RetryPolicy
+}
+
+var DefaultWebhookConfig = WebhookConfig{
+	Timeout: 10 * time.Second,
+	Retry: RetryPolicy{
+		MaxAttempts: 8,
+		BaseDelay:   10 * time.Second,
+		MaxDelay:    time.Hour,
+		Jitter:      0.2,
+	},
+}
+
+// WithWebhooks sets how task callbacks are delivered.
+func WithWebhooks(cfg WebhookConfig) Option {
+	return func(s *taskService) {
+		s.webhooks = cfg
+	}
+}
+
+// newCallbackClient returns the client for callbacks. Whatever the transport,
+// callbacks don't follow redirects: the receiver is expected to answer at
+// the URL the client gave.
+func (s *taskService) newCallbackClient() *http.Client {
+	var transport http.RoundTripper
+	switch {
+	case s.httpClient != nil:
+		transport = s.httpClient.Transport
+	case s.guard != nil:
+		transport = s.guard.Client().Transport
+	}
+	return &http.Client{
+		Transport:     transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+}
+
+func (s *taskService) validateCallbackURL(callbackURL string) error {
+	if callbackURL == "" {
+		return nil
+	}
+	u, err := url.Parse(callbackURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%w: %q", ErrBadCallbackURL, callbackURL)
+	}
+	if s.guard != nil {
+		if err := s.guard.CheckURL(callbackURL); err != nil {
+			return fmt.Errorf("%w: %s", ErrBadCallbackURL, err)
+		}
+	}
+	if len(s.webhooks.Secret) == 0 {
+		return ErrCallbacksDisabled
+	}
+	return nil
+}
+
+// signCallback returns the value of SignatureHeader for the body sent at
+// timestamp.
+func signCallback(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// callbackQueue indexes the pending callbacks by task ID with the time the
+// next attempt is due, so that the delivery loop doesn't have to look
+// through all the tasks.
+type callbackQueue struct {
+	mu  sync.Mutex
+	due map[string]time.Time
+	// loaded is set once the pending callbacks of tasks stored before the
+	// start are added.
+	loaded bool
+}
+
+func newCallbackQueue() *callbackQueue {
+	return &callbackQueue{due: make(map[string]time.Time)}
+}
+
+func (q *callbackQueue) add(task model.Task) {
+	at := time.Now()
+	if task.Callback.NextAttemptAt != nil {
+		at = *task.Callback.NextAttemptAt
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.due[task.ID] = at
+}
+
+func (q *callbackQueue) set(taskID string, at time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if at.IsZero() {
+		delete(q.due, taskID)
+	} else {
+		q.due[taskID] = at
+	}
+}
+
+// snapshot returns the task IDs of the callbacks that are due and when the
+// next one of the rest is.
+func (q *callbackQueue) snapshot() (due []string, next time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	for id, at := range q.due {
+		if !at.After(now) {
+			due = append(due, id)
+		} else if next.IsZero() || at.Before(next) {
+			next = at
+		}
+	}
+	return due, next
+}
+
+// enqueueCallback adds the pending callback of the task to the queue and
+// wakes the delivery loop.
+func (s *taskService) enqueueCallback(task model.Task) {
+	s.callbackQueue.add(task)
+	select {
+	case s.callbacks <- struct{}{}:
+	default:
+	}
+}
+
+// loadCallbacks adds the pending callbacks of stored tasks to the queue, once.
+func (s *taskService) loadCallbacks(ctx context.Context) error {
+	if s.callbackQueue.loaded {
+		return nil
+	}
+	tasks, err := s.taskStore.List(ctx)
+	if err != nil {
+		return err
+	}
+	for _, task := range tasks {
+		if task.Callback != nil && task.Callback.Status == model.DeliveryPending {
+			s.callbackQueue.add(task)
+		}
+	}
+	s.callbackQueue.loaded = true
+	return nil
+}
+
+// deliverCallbacks sends the callbacks of finished tasks until ctx is
+// canceled. Pending deliveries live in the tasks, so the loop finds them
+// again after a restart; it sleeps until the next one is due or a task
+// finishes.
+func (s *taskService) deliverCallbacks(ctx context.Context) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.callbacks:
+		case <-timer.C:
+		}
+
+		next, err := s.deliverDue(ctx)
+		if err != nil {
+			s.log.Errorf("failed to deliver callbacks: %s", err)
+			next = time.Now().Add(s.webhooks.Retry.BaseDelay)
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		if !next.IsZero() {
+			timer.Reset(max(time.Until(next), 0))
+		}
+	}
+}
+
+// deliverDue makes an attempt for every callback that is due and returns
+// when the next pending one is, or zero time if none is left.
+func (s *taskService) deliverDue(ctx context.Context) (time.Time, error) {
+	if err := s.loadCallbacks(ctx); err != nil {
+		return time.Time{}, err
+	}
+
+	due, next := s.callbackQueue.snapshot()
+	for _, taskID := range due {
+		task, err := s.taskStore.Get(ctx, taskID)
+		if err != nil {
+			s.log.Errorf("failed to get task ID %s for its callback: %s", taskID, err)
+			s.callbackQueue.set(taskID, time.Time{})
+			continue
+		}
+		if task.Callback == nil || task.Callback.Status != model.DeliveryPending {
+			s.callbackQueue.set(taskID, time.Time{})
+			continue
+		}
+
+		retryAt, err := s.deliverCallback(ctx, task)
+		if ctx.Err() != nil {
+			return time.Time{}, nil
+		}
+		if err != nil {
+			s.log.Errorf("failed to record callback of task ID %s: %s", task.ID, err)
+			retryAt = time.Now().Add(s.webhooks.Retry.BaseDelay)
+		}
+		s.callbackQueue.set(taskID, retryAt)
+		if !retryAt.IsZero() && (next.IsZero() || retryAt.Before(next)) {
+			next = retryAt
+		}
+	}
+	return next, nil
+}
+
+// deliverCallback makes one attempt to deliver the callback of the task and
+// records it. It returns when the next attempt is due if the callback is
+// still pending.
+func (s *taskService) deliverCallback(ctx context.Context, task model.Task) (time.Time, error) {
+	view := task.Clone()
+	s.withArchiveLink(&view)
+	body, err := json.Marshal(view)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	attempt := model.Attempt{Number: len(task.Callback.Attempts) + 1, StartedAt: time.Now()}
+	statusCode, err := s.postCallback(ctx, task.CallbackURL, body)
+	if ctx.Err() != nil {
+		return time.Time{}, nil
+	}
+	attempt.StatusCode = statusCode
+	if err != nil {
+		attempt.Error = err.Error()
+	}
+
+	s.lifecycle.Lock()
+	defer s.lifecycle.Unlock()
+
+	task, gErr := s.taskStore.Get(ctx, task.ID)
+	if gErr != nil {
+		return time.Time{}, gErr
+	}
+	cb := *task.Callback
+	cb.Attempts = append(cb.Attempts, attempt)
+	cb.NextAttemptAt = nil
+
+	var retryAt time.Time
+	switch {
+	case err == nil:
+		cb.Status = model.DeliveryDelivered
+		s.log.Infoln("callback of task ID", task.ID, "delivered")
+	case !callbackRetryable(statusCode) || errors.Is(err, netguard.ErrBlocked) || errors.Is(err, ErrCallbacksDisabled) || attempt.Number >= max(s.webhooks.Retry.MaxAttempts, 1):
+		cb.Status = model.DeliveryFailed
+		s.log.Errorf("callback of task ID %s failed after %d attempts: %s", task.ID, attempt.Number, err)
+	default:
+		retryAt = time.Now().Add(s.webhooks.Retry.delay(attempt.Number, nil))
+		cb.NextAttemptAt = &retryAt
+	}
+	task.Callback = &cb
+	return retryAt, s.taskStore.Update(ctx, task)
+}
+
+func (s *taskService) postCallback(ctx context.Context, callbackURL string, body []byte) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.webhooks.Timeout)
+	defer cancel()
+
+	// Tasks stored before the secret was unset can't be signed either.
+	if len(s.webhooks.Secret) == 0 {
+		return 0, ErrCallbacksDisabled
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, callbackURL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(SignatureHeader, signCallback(s.webhooks.Secret, timestamp, body))
+
+	resp, err := s.callbackClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// callbackRetryable reports whether a callback that got statusCode is worth
+// another attempt: the receiver was unreachable, overloaded or broken.
+func callbackRetryable(statusCode int) bool {
+	return statusCode == 0 || statusCode == http.StatusRequestTimeout || statusCode == http.StatusTooManyRequests || statusCode >= 500
+}
@@ -0,0 +1,228 @@
+package services
+
+import (
+	"archive/zip"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"hash"
+	"io"
+	"time"
+	"unicode/utf8"
+)
+
+// WinZip AE-2 encryption, see https://www.winzip.com/en/support/aes-encryption/.
+// The entry data is the salt, a password verifier, the compressed content
+// encrypted with AES-256 in CTR mode and an HMAC-SHA1 of the ciphertext.
+const (
+	aesMethod      = 99
+	aesExtraID     = 0x9901
+	aesVersion     = 2
+	aesStrength256 = 3
+	aesKeyLen      = 32
+	aesSaltLen     = 16
+	aesVerifierLen = 2
+	aesMACLen      = 10
+	aesIterations  = 1000
+
+	zipFlagEncrypted      = 0x1
+	zipFlagDataDescriptor = 0x8
+	zipFlagUTF8           = 0x800
+	zipVersionAES         = 51
+)
+
+// aesEntry is an open encrypted entry. It must be closed before the next
+// entry is created or the zip writer is closed.
+type aesEntry struct {
+	fh         *zip.FileHeader
+	raw        io.Writer
+	stream     cipher.Stream
+	mac        hash.Hash
+	compressor io.WriteCloser
+
+	size    uint64
+	written uint64
+}
+
+// createAESEntry starts an entry encrypted with password. The compression
+// method of fh becomes the method of the content inside the encryption.
+func createAESEntry(zw *zip.Writer, fh *zip.FileHeader, password string, level int) (*aesEntry, error) {
+	method := fh.Method
+
+	extra := make([]byte, 11)
+	binary.LittleEndian.PutUint16(extra[0:], aesExtraID)
+	binary.LittleEndian.PutUint16(extra[2:], 7)
+	binary.LittleEndian.PutUint16(extra[4:], aesVersion)
+	copy(extra[6:], "AE")
+	extra[8] = aesStrength256
+	binary.LittleEndian.PutUint16(extra[9:], method)
+
+	fh.Method = aesMethod
+	fh.Flags |= zipFlagEncrypted | zipFlagDataDescriptor
+	if !isASCII(fh.Name) {
+		fh.Flags |= zipFlagUTF8
+	}
+	fh.Extra = append(fh.Extra, extra...)
+	fh.CreatorVersion = 3<<8 | zipVersionAES
+	fh.ReaderVersion = zipVersionAES
+	fh.SetModTime(time.Now())
+
+	raw, err := zw.CreateRaw(fh)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, aesSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	keys := pbkdf2SHA1([]byte(password), salt, aesIterations, 2*aesKeyLen+aesVerifierLen)
+	block, err := aes.NewCipher(keys[:aesKeyLen])
+	if err != nil {
+		return nil, err
+	}
+
+	e := &aesEntry{
+		fh:     fh,
+		raw:    raw,
+		stream: newWinZipCTR(block),
+		mac:    hmac.New(sha1.New, keys[aesKeyLen:2*aesKeyLen]),
+	}
+	if _, err := raw.Write(salt); err != nil {
+		return nil, err
+	}
+	if _, err := raw.Write(keys[2*aesKeyLen:]); err != nil {
+		return nil, err
+	}
+	e.written = aesSaltLen + aesVerifierLen
+
+	if method == zip.Deflate {
+		if level == 0 {
+			level = flate.DefaultCompression
+		}
+		e.compressor, err = flate.NewWriter(encryptingWriter{e}, level)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+func (e *aesEntry) Write(p []byte) (int, error) {
+	e.size += uint64(len(p))
+	if e.compressor != nil {
+		return e.compressor.Write(p)
+	}
+	return encryptingWriter{e}.Write(p)
+}
+
+// Close writes the authentication code and fills in the sizes, which the zip
+// writer puts into the data descriptor and the central directory.
+func (e *aesEntry) Close() error {
+	if e.compressor != nil {
+		if err := e.compressor.Close(); err != nil {
+			return err
+		}
+	}
+	n, err := e.raw.Write(e.mac.Sum(nil)[:aesMACLen])
+	if err != nil {
+		return err
+	}
+	e.written += uint64(n)
+
+	e.fh.CRC32 = 0
+	e.fh.CompressedSize64 = e.written
+	e.fh.UncompressedSize64 = e.size
+	e.fh.CompressedSize = uint32(min(e.written, uint32max))
+	e.fh.UncompressedSize = uint32(min(e.size, uint32max))
+	return nil
+}
+
+const uint32max = (1 << 32) - 1
+
+type encryptingWriter struct {
+	e *aesEntry
+}
+
+func (w encryptingWriter) Write(p []byte) (int, error) {
+	buf := make([]byte, len(p))
+	w.e.stream.XORKeyStream(buf, p)
+	w.e.mac.Write(buf)
+	n, err := w.e.raw.Write(buf)
+	w.e.written += uint64(n)
+	return n, err
+}
+
+// winZipCTR is AES in CTR mode with the little-endian counter starting at 1
+// that WinZip uses, unlike the big-endian one of cipher.NewCTR.
+type winZipCTR struct {
+	block   cipher.Block
+	counter [aes.BlockSize]byte
+	buf     [aes.BlockSize]byte
+	pos     int
+}
+
+func newWinZipCTR(block cipher.Block) *winZipCTR {
+	return &winZipCTR{block: block, pos: aes.BlockSize}
+}
+
+func (c *winZipCTR) XORKeyStream(dst, src []byte) {
+	for i := range src {
+		if c.pos == aes.BlockSize {
+			for j := range c.counter {
+				c.counter[j]++
+				if c.counter[j] != 0 {
+					break
+				}
+			}
+			c.block.Encrypt(c.buf[:], c.counter[:])
+			c.pos = 0
+		}
+		dst[i] = src[i] ^ c.buf[c.pos]
+		c.pos++
+	}
+}
+
+// pbkdf2SHA1 derives a key as specified in RFC 8018 with HMAC-SHA1 as the
+// pseudorandom function.
+func pbkdf2SHA1(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha1.New, password)
+	hashLen := prf.Size()
+	blocks := (keyLen + hashLen - 1) / hashLen
+
+	key := make([]byte, 0, blocks*hashLen)
+	u := make([]byte, hashLen)
+	var index [4]byte
+	for block := 1; block <= blocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(index[:], uint32(block))
+		prf.Write(index[:])
+		key = prf.Sum(key)
+		t := key[len(key)-hashLen:]
+		copy(u, t)
+
+		for range iterations - 1 {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for i := range u {
+				t[i] ^= u[i]
+			}
+		}
+	}
+	return key[:keyLen]
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,144 @@
+package boltstorage
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/DeneesK/file-downloader/internal/app/model"
+	"github.com/DeneesK/file-downloader/internal/app/storage"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	dirPerm     = 0755
+	filePerm    = 0600
+	openTimeout = time.Second
+)
+
+var tasksBucket = []byte("tasks")
+
+var errNoBucket = errors.New("tasks bucket not found")
+
+// BoltStorage keeps tasks in an embedded bbolt database file, so that they
+// survive restarts. Tasks are encoded with gob to keep the fields hidden from
+// the JSON API.
+type BoltStorage struct {
+	db *bolt.DB
+}
+
+func NewBoltStorage(path string) (*BoltStorage, error) {
+	if err := os.MkdirAll(filepath.Dir(path), dirPerm); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path, filePerm, &bolt.Options{Timeout: openTimeout})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(tasksBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltStorage{db: db}, nil
+}
+
+func (s *BoltStorage) Store(ctx context.Context, value *model.Task) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	data, err := encode(*value)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(tasksBucket)
+		if b.Get([]byte(value.ID)) != nil {
+			return storage.ErrNotUniqueVallation
+		}
+		return b.Put([]byte(value.ID), data)
+	})
+}
+
+func (s *BoltStorage) Get(ctx context.Context, id string) (model.Task, error) {
+	if err := ctx.Err(); err != nil {
+		return model.Task{}, err
+	}
+	var task model.Task
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(tasksBucket).Get([]byte(id))
+		if data == nil {
+			return storage.ErrNotFound
+		}
+		return decode(data, &task)
+	})
+	return task, err
+}
+
+func (s *BoltStorage) Update(ctx context.Context, task model.Task) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	data, err := encode(task)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(tasksBucket).Put([]byte(task.ID), data)
+	})
+}
+
+func (s *BoltStorage) List(ctx context.Context) ([]model.Task, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var tasks []model.Task
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(tasksBucket).ForEach(func(_, data []byte) error {
+			var task model.Task
+			if err := decode(data, &task); err != nil {
+				return err
+			}
+			tasks = append(tasks, task)
+			return nil
+		})
+	})
+	return tasks, err
+}
+
+func (s *BoltStorage) Ping(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(tasksBucket) == nil {
+			return errNoBucket
+		}
+		return nil
+	})
+}
+
+func (s *BoltStorage) Close(ctx context.Context) error {
+	return s.db.Close()
+}
+
+func encode(task model.Task) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(task); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decode(data []byte, task *model.Task) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(task)
+}
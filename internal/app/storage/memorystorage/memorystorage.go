@@ -25,7 +25,8 @@ func (s *MemoryStorage) Store(ctx context.Context, value *model.Task) error {
 	if s.isExists(value.ID) {
 		return storage.ErrNotUniqueVallation
 	}
-	s.storage[value.ID] = value
+	task := value.Clone()
+	s.storage[value.ID] = &task
 	return nil
 }
 
@@ -35,17 +36,27 @@ func (s *MemoryStorage) Get(ctx context.Context, id string) (model.Task, error)
 	if !(s.isExists(id)) {
 		return model.Task{}, storage.ErrNotFound
 	}
-	task := *s.storage[id]
-	return task, nil
+	return s.storage[id].Clone(), nil
 }
 
 func (s *MemoryStorage) Update(ctx context.Context, task model.Task) error {
 	s.m.Lock()
 	defer s.m.Unlock()
+	task = task.Clone()
 	s.storage[task.ID] = &task
 	return nil
 }
 
+func (s *MemoryStorage) List(ctx context.Context) ([]model.Task, error) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	tasks := make([]model.Task, 0, len(s.storage))
+	for _, task := range s.storage {
+		tasks = append(tasks, task.Clone())
+	}
+	return tasks, nil
+}
+
 func (s *MemoryStorage) Ping(ctx context.Context) error {
 	return nil
 }
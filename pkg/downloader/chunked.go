@@ -0,0 +1,211 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// errNoRanges means the server can't be used for a chunked download and the
+// file has to be fetched over a single stream.
+var errNoRanges = errors.New("server does not support byte ranges")
+
+type remoteFile struct {
+	size         int64
+	etag         string
+	lastModified string
+	contentType  string
+	disposition  string
+}
+
+// resumeChunked splits the missing part of the file into byte ranges and
+// fetches them concurrently. On failure st.Offset is moved to the end of the
+// contiguous prefix that was received, so the download can still be resumed.
+func (d *Downloader) resumeChunked(ctx context.Context, url string, st *State) error {
+	rf, err := d.head(ctx, url)
+	if err != nil {
+		return errNoRanges
+	}
+	if st.Offset > 0 && (rf.etag != st.ETag || rf.lastModified != st.LastModified) {
+		st.reset()
+	}
+
+	n := d.chunkCount(rf.size - st.Offset)
+	if n < 2 {
+		return errNoRanges
+	}
+	st.Size = rf.size
+	st.ETag = rf.etag
+	st.LastModified = rf.lastModified
+	st.ContentType = rf.contentType
+	st.ContentDisposition = rf.disposition
+
+	if err := d.checkHead(ctx, url, st); err != nil {
+		return err
+	}
+	if err := st.checkSize(rf.size); err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(st.Path, os.O_WRONLY|os.O_CREATE, filePerm)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if err := out.Truncate(rf.size); err != nil {
+		return err
+	}
+
+	chunkSize := (rf.size - st.Offset) / int64(n)
+	starts := make([]int64, n)
+	lengths := make([]int64, n)
+	written := make([]int64, n)
+	for i := range n {
+		starts[i] = st.Offset + int64(i)*chunkSize
+		lengths[i] = chunkSize
+	}
+	lengths[n-1] = rf.size - starts[n-1]
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var received atomic.Int64
+	received.Store(st.Offset)
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := st.track(io.NewOffsetWriter(out, starts[i]), &received)
+			err := d.fetchRange(ctx, url, st.validator(), starts[i], lengths[i], rf.size, &countingWriter{w: w, n: &written[i]})
+			if err != nil {
+				once.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i := range n {
+		st.Offset += written[i]
+		if written[i] < lengths[i] {
+			break
+		}
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+
+	fi, err := out.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() != rf.size || st.Offset != rf.size {
+		return ErrIncomplete
+	}
+	st.StatusCode = http.StatusPartialContent
+	st.Done = true
+	return nil
+}
+
+// checkHead runs st.Check before the chunks are fetched, on the start of the
+// file fetched separately unless it is already stored.
+func (d *Downloader) checkHead(ctx context.Context, url string, st *State) error {
+	if st.Check == nil {
+		return nil
+	}
+	stored, err := st.storedHead()
+	if err != nil {
+		return err
+	}
+	if len(stored) == SniffLen {
+		return st.Check(st, stored)
+	}
+
+	var head bytes.Buffer
+	length := min(SniffLen, st.Size)
+	if err := d.fetchRange(ctx, url, st.validator(), 0, length, st.Size, &head); err != nil {
+		return err
+	}
+	return st.Check(st, head.Bytes())
+}
+
+func (d *Downloader) chunkCount(remaining int64) int {
+	n := int64(d.cfg.Chunks)
+	if d.cfg.MinChunkSize > 0 {
+		n = min(n, remaining/d.cfg.MinChunkSize)
+	}
+	return int(n)
+}
+
+// head asks the server for the file size and whether it accepts byte ranges.
+func (d *Downloader) head(ctx context.Context, url string) (remoteFile, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return remoteFile{}, err
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return remoteFile{}, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Accept-Ranges") != "bytes" || resp.ContentLength <= 0 {
+		return remoteFile{}, errNoRanges
+	}
+	return remoteFile{
+		size:         resp.ContentLength,
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+		contentType:  resp.Header.Get("Content-Type"),
+		disposition:  resp.Header.Get("Content-Disposition"),
+	}, nil
+}
+
+func (d *Downloader) fetchRange(ctx context.Context, url, validator string, start, length, size int64, w io.Writer) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, start+length-1))
+	if validator != "" {
+		req.Header.Set("If-Range", validator)
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		return errNoRanges
+	default:
+		return newStatusError(resp)
+	}
+	from, total, ok := parseContentRange(resp.Header.Get("Content-Range"))
+	if !ok || from != start || total != size {
+		return errNoRanges
+	}
+
+	n, err := io.Copy(w, io.LimitReader(resp.Body, length))
+	if err != nil {
+		return err
+	}
+	if n != length {
+		return ErrIncomplete
+	}
+	return nil
+}
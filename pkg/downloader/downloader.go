@@ -1,32 +1,482 @@
 package downloader
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/DeneesK/file-downloader/pkg/validator"
 	"github.com/google/uuid"
 )
 
+const filePerm = 0644
+
+// SniffLen is how many first bytes of a file are passed to State.Check.
+const SniffLen = 512
+
+var ErrIncomplete = errors.New("download incomplete: connection closed before the whole file was received")
+
+// ErrTooLarge is returned when the file is bigger than State.MaxSize.
+var ErrTooLarge = errors.New("file is too large")
+
+// StatusError is returned when the server answers with an unexpected status.
+// RetryAfter is set when the response carried a Retry-After header.
+type StatusError struct {
+	StatusCode int
+	Status     string
+	RetryAfter time.Duration
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status: %s", e.Status)
+}
+
+func newStatusError(resp *http.Response) *StatusError {
+	return &StatusError{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+}
+
+// State describes a file that is being downloaded. Resume updates it in place,
+// so the caller can persist it and continue the download later from Offset.
+type State struct {
+	Path         string
+	Offset       int64
+	Size         int64
+	ETag         string
+	LastModified string
+	Done         bool
+	StatusCode   int
+	ContentType  string
+	// ContentDisposition is the header of the response, which may suggest a
+	// filename.
+	ContentDisposition string
+
+	// Progress, if set, is called as data arrives with the number of bytes
+	// of the file received so far and its size, -1 if unknown. It may be
+	// called from several goroutines at once.
+	Progress func(received, total int64)
+
+	// Check, if set, vets the file before any of it is stored: it is called
+	// with the state, which describes the response by then, and the first
+	// SniffLen bytes of the file, fewer only if the file is shorter. An error
+	// aborts the download and is returned as is. Check may set MaxSize.
+	Check func(st *State, head []byte) error
+
+	// MaxSize, if positive, is the largest file accepted. A bigger one fails
+	// with ErrTooLarge as soon as the response tells its size, or once more
+	// than MaxSize bytes of it arrive.
+	MaxSize int64
+
+	// Claim, if set, is called before bytes of the file are stored with the
+	// size the file takes up to them: its full size as soon as the response
+	// tells it, otherwise the end of the data received so far. An error
+	// aborts the download and is returned as is. It lets several downloads
+	// share a limit.
+	Claim func(size int64) error
+}
+
+// Config tunes a Downloader. Files are split into at most Chunks byte ranges
+// fetched in parallel, each at least MinChunkSize bytes long. Chunks <= 1
+// disables parallel downloading. Client makes the requests,
+// http.DefaultClient if nil.
+type Config struct {
+	Chunks       int
+	MinChunkSize int64
+	Client       *http.Client
+}
+
+type Downloader struct {
+	client *http.Client
+	cfg    Config
+}
+
+func New(cfg Config) *Downloader {
+	client := cfg.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &Downloader{
+		client: client,
+		cfg:    cfg,
+	}
+}
+
+var defaultDownloader = New(Config{})
+
 func DownloadFile(url string) (string, error) {
+	st := &State{Path: filepath.Join(os.TempDir(), uuid.NewString()+filepath.Ext(url))}
+	err := Resume(context.Background(), url, st)
+	return st.Path, err
+}
+
+func Resume(ctx context.Context, url string, st *State) error {
+	return defaultDownloader.Resume(ctx, url, st)
+}
+
+// Resume continues the download described by st. If the file was partially
+// received it asks the server only for the missing bytes and falls back to
+// a full download when the server ignores the range or the file has changed.
+func (d *Downloader) Resume(ctx context.Context, url string, st *State) error {
+	if !(validator.IsValidURL(url)) {
+		return fmt.Errorf("%w: %s", validator.ErrNotValidURL, url)
+	}
+	if st.Done {
+		return nil
+	}
+	if st.Offset > 0 && !hasPartial(st) {
+		st.reset()
+	}
+
+	if d.cfg.Chunks > 1 {
+		err := d.resumeChunked(ctx, url, st)
+		if !errors.Is(err, errNoRanges) {
+			return err
+		}
+	}
+	return d.resumeStream(ctx, url, st)
+}
+
+// Stream downloads the file without storing it on disk. The body is written
+// to the writer returned by open, which is called only after the server has
+// answered successfully and st describes the response.
+func (d *Downloader) Stream(ctx context.Context, url string, st *State, open func(st *State) (io.Writer, error)) error {
 	if !(validator.IsValidURL(url)) {
-		return "", fmt.Errorf("not valid url: %s", url)
+		return fmt.Errorf("%w: %s", validator.ErrNotValidURL, url)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	st.StatusCode = resp.StatusCode
+
+	if resp.StatusCode != http.StatusOK {
+		return newStatusError(resp)
+	}
+	st.reset()
+	st.Size = resp.ContentLength
+	st.ETag = resp.Header.Get("ETag")
+	st.LastModified = resp.Header.Get("Last-Modified")
+	st.ContentType = resp.Header.Get("Content-Type")
+	st.ContentDisposition = resp.Header.Get("Content-Disposition")
+
+	head, err := st.sniff(nil, resp.Body)
+	if err != nil {
+		return err
+	}
+	if err := st.checkSize(st.Size); err != nil {
+		return err
+	}
+	w, err := open(st)
+	if err != nil {
+		return err
+	}
+	var received atomic.Int64
+	_, err = io.Copy(&countingWriter{w: st.track(w, &received), n: &st.Offset}, st.limit(io.MultiReader(bytes.NewReader(head), resp.Body)))
+	if err != nil {
+		return err
 	}
-	resp, err := http.Get(url)
-	if err != nil || resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("error: %v", err)
+	if st.Size >= 0 && st.Offset != st.Size {
+		return ErrIncomplete
+	}
+	st.Done = true
+	return nil
+}
+
+// resumeStream downloads the rest of the file over a single connection.
+func (d *Downloader) resumeStream(ctx context.Context, url string, st *State) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	if st.Offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", st.Offset))
+		if v := st.validator(); v != "" {
+			req.Header.Set("If-Range", v)
+		}
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
 	}
 	defer resp.Body.Close()
+	st.StatusCode = resp.StatusCode
+
+	var stored []byte
+	switch resp.StatusCode {
+	case http.StatusOK:
+		st.reset()
+		st.Size = resp.ContentLength
+		st.ETag = resp.Header.Get("ETag")
+		st.LastModified = resp.Header.Get("Last-Modified")
+		st.ContentType = resp.Header.Get("Content-Type")
+		st.ContentDisposition = resp.Header.Get("Content-Disposition")
+	case http.StatusPartialContent:
+		start, total, ok := parseContentRange(resp.Header.Get("Content-Range"))
+		if !ok || start != st.Offset {
+			st.reset()
+			return fmt.Errorf("unexpected content range %q", resp.Header.Get("Content-Range"))
+		}
+		st.Size = total
+		st.ContentType = resp.Header.Get("Content-Type")
+		st.ContentDisposition = resp.Header.Get("Content-Disposition")
+		if stored, err = st.storedHead(); err != nil {
+			return err
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		if st.Size > 0 && st.Offset == st.Size {
+			st.Done = true
+			return nil
+		}
+		st.reset()
+		return newStatusError(resp)
+	default:
+		return newStatusError(resp)
+	}
+
+	head, err := st.sniff(stored, resp.Body)
+	if err != nil {
+		return err
+	}
+	if err := st.checkSize(st.Size); err != nil {
+		return err
+	}
 
-	filename := filepath.Join(os.TempDir(), uuid.NewString()+filepath.Ext(url))
-	out, err := os.Create(filename)
+	out, err := os.OpenFile(st.Path, os.O_WRONLY|os.O_CREATE, filePerm)
 	if err != nil {
-		return "", err
+		return err
 	}
 	defer out.Close()
-	_, err = io.Copy(out, resp.Body)
-	return filename, err
+
+	if err := out.Truncate(st.Offset); err != nil {
+		return err
+	}
+	if _, err := out.Seek(st.Offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	var received atomic.Int64
+	received.Store(st.Offset)
+	_, err = io.Copy(&countingWriter{w: st.track(out, &received), n: &st.Offset}, st.limit(io.MultiReader(bytes.NewReader(head), resp.Body)))
+	if err != nil {
+		return err
+	}
+	if st.Size >= 0 && st.Offset != st.Size {
+		return ErrIncomplete
+	}
+	st.Done = true
+	return nil
+}
+
+// sniff reads the start of body, which follows the stored bytes of the file,
+// so that the first SniffLen bytes of the file can be passed to st.Check. It
+// returns the bytes read from body, which are yet to be written.
+func (st *State) sniff(stored []byte, body io.Reader) ([]byte, error) {
+	if st.Check == nil {
+		return nil, nil
+	}
+	head := make([]byte, max(SniffLen-len(stored), 0))
+	n, err := io.ReadFull(body, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	head = head[:n]
+	if err := st.Check(st, append(stored, head...)); err != nil {
+		return nil, err
+	}
+	return head, nil
+}
+
+// storedHead returns the first bytes of the partial file to be checked
+// along with the rest of the download.
+func (st *State) storedHead() ([]byte, error) {
+	if st.Check == nil || st.Offset == 0 {
+		return nil, nil
+	}
+	f, err := os.Open(st.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	head := make([]byte, min(st.Offset, SniffLen))
+	if _, err := io.ReadFull(f, head); err != nil {
+		return nil, err
+	}
+	return head, nil
+}
+
+// checkSize returns ErrTooLarge if a file of size is bigger than st.MaxSize,
+// or the error of st.Claim.
+func (st *State) checkSize(size int64) error {
+	if st.MaxSize > 0 && size > st.MaxSize {
+		return fmt.Errorf("%w: %d bytes, limit is %d", ErrTooLarge, size, st.MaxSize)
+	}
+	if st.Claim != nil && size >= 0 {
+		return st.Claim(size)
+	}
+	return nil
+}
+
+// limit wraps body, which continues the file from st.Offset, so that
+// reading more than st.MaxSize bytes of the file fails with ErrTooLarge and
+// the data read is claimed.
+func (st *State) limit(body io.Reader) io.Reader {
+	if st.MaxSize <= 0 && st.Claim == nil {
+		return body
+	}
+	return &limitedReader{r: body, offset: st.Offset, max: st.MaxSize, claim: st.Claim}
+}
+
+type limitedReader struct {
+	r      io.Reader
+	offset int64
+	max    int64
+	claim  func(size int64) error
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.max > 0 {
+		if l.offset > l.max {
+			return 0, fmt.Errorf("%w: more than %d bytes", ErrTooLarge, l.max)
+		}
+		if int64(len(p)) > l.max-l.offset+1 {
+			p = p[:l.max-l.offset+1]
+		}
+	}
+	n, err := l.r.Read(p)
+	if l.max > 0 && l.offset+int64(n) > l.max {
+		n, l.offset = int(l.max-l.offset), l.max+1
+		return n, fmt.Errorf("%w: more than %d bytes", ErrTooLarge, l.max)
+	}
+	if l.claim != nil && n > 0 {
+		if cErr := l.claim(l.offset + int64(n)); cErr != nil {
+			return 0, cErr
+		}
+	}
+	l.offset += int64(n)
+	return n, err
+}
+
+func (st *State) reset() {
+	st.Offset = 0
+	st.Size = -1
+	st.ETag = ""
+	st.LastModified = ""
+	st.ContentType = ""
+	st.ContentDisposition = ""
+	st.Done = false
+}
+
+// validator returns the value for the If-Range header. Weak ETags are not
+// allowed there, so Last-Modified is used instead.
+func (st *State) validator() string {
+	if st.ETag != "" && !strings.HasPrefix(st.ETag, "W/") {
+		return st.ETag
+	}
+	return st.LastModified
+}
+
+func hasPartial(st *State) bool {
+	fi, err := os.Stat(st.Path)
+	if err != nil {
+		return false
+	}
+	return fi.Size() >= st.Offset && st.validator() != ""
+}
+
+// parseContentRange parses "bytes start-end/total". Total is -1 when the
+// server reports it as unknown.
+func parseContentRange(h string) (start, total int64, ok bool) {
+	h, found := strings.CutPrefix(h, "bytes ")
+	if !found {
+		return 0, 0, false
+	}
+	rng, size, found := strings.Cut(h, "/")
+	if !found {
+		return 0, 0, false
+	}
+	from, _, found := strings.Cut(rng, "-")
+	if !found {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(from, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	if size == "*" {
+		return start, -1, true
+	}
+	total, err = strconv.ParseInt(size, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return start, total, true
+}
+
+// parseRetryAfter accepts both forms of Retry-After: delay in seconds and
+// an HTTP date.
+func parseRetryAfter(h string) time.Duration {
+	if h == "" {
+		return 0
+	}
+	if sec, err := strconv.Atoi(h); err == nil && sec > 0 {
+		return time.Duration(sec) * time.Second
+	}
+	if t, err := http.ParseTime(h); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// track wraps w to report the bytes written through it, counted in received,
+// to st.Progress.
+func (st *State) track(w io.Writer, received *atomic.Int64) io.Writer {
+	if st.Progress == nil {
+		return w
+	}
+	return &progressWriter{w: w, received: received, total: st.Size, report: st.Progress}
+}
+
+type progressWriter struct {
+	w        io.Writer
+	received *atomic.Int64
+	total    int64
+	report   func(received, total int64)
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.report(w.received.Add(int64(n)), w.total)
+	return n, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	*w.n += int64(n)
+	return n, err
 }
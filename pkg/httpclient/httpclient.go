@@ -0,0 +1,185 @@
+// Package httpclient builds the client outbound requests of the service are
+// made with: bounded in time at every stage, optionally proxied and with
+// its own trusted CAs and client certificate.
+package httpclient
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/DeneesK/file-downloader/pkg/netguard"
+)
+
+// ErrIdleTimeout is returned by a response body that delivered no data for
+// longer than Config.IdleReadTimeout.
+var ErrIdleTimeout = errors.New("response body stalled")
+
+// Config sets up the client. Zero timeouts and pool limits mean none.
+type Config struct {
+	ConnectTimeout        time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	// IdleReadTimeout fails a response whose body delivers no data for that
+	// long, however long the whole download takes.
+	IdleReadTimeout time.Duration
+
+	// Proxy is the URL of the proxy for all requests. If empty, HTTP_PROXY,
+	// HTTPS_PROXY and NO_PROXY are used.
+	Proxy string
+	// CAFile is a PEM bundle of CAs trusted in addition to the system ones.
+	CAFile string
+	// CertFile and KeyFile are the PEM client certificate and key presented
+	// to servers that ask for one.
+	CertFile string
+	KeyFile  string
+
+	UserAgent string
+
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	MaxConnsPerHost     int
+	IdleConnTimeout     time.Duration
+
+	// Guard, if set, checks every connection and redirect of the client.
+	Guard *netguard.Guard
+}
+
+func New(cfg Config) (*http.Client, error) {
+	proxy := http.ProxyFromEnvironment
+	if cfg.Proxy != "" {
+		u, err := url.Parse(cfg.Proxy)
+		if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5") {
+			return nil, fmt.Errorf("bad proxy url %q", cfg.Proxy)
+		}
+		proxy = http.ProxyURL(u)
+	}
+	tlsConfig, err := newTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{Timeout: cfg.ConnectTimeout, KeepAlive: 30 * time.Second}
+	t := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig,
+		ForceAttemptHTTP2:     true,
+		TLSHandshakeTimeout:   cfg.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: cfg.ResponseHeaderTimeout,
+		ExpectContinueTimeout: time.Second,
+		MaxIdleConns:          cfg.MaxIdleConns,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       cfg.MaxConnsPerHost,
+		IdleConnTimeout:       cfg.IdleConnTimeout,
+	}
+	client := &http.Client{Transport: t}
+	if cfg.Guard != nil {
+		cfg.Guard.Protect(t, dialer)
+		client.CheckRedirect = cfg.Guard.CheckRedirect
+	}
+	if cfg.UserAgent != "" {
+		client.Transport = &userAgent{next: client.Transport, userAgent: cfg.UserAgent}
+	}
+	if cfg.IdleReadTimeout > 0 {
+		client.Transport = &idleTimeout{next: client.Transport, timeout: cfg.IdleReadTimeout}
+	}
+	return client, nil
+}
+
+func newTLSConfig(cfg Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", cfg.CAFile)
+		}
+		tlsConfig.RootCAs = roots
+	}
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		if cfg.CertFile == "" || cfg.KeyFile == "" {
+			return nil, errors.New("client certificate and key must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// userAgent sets the User-Agent of requests that don't have one.
+type userAgent struct {
+	next      http.RoundTripper
+	userAgent string
+}
+
+func (t *userAgent) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("User-Agent") == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("User-Agent", t.userAgent)
+	}
+	return t.next.RoundTrip(req)
+}
+
+// idleTimeout cancels requests whose response body stalls. Only the time
+// spent waiting for data counts, not the time the reader takes between
+// reads.
+type idleTimeout struct {
+	next    http.RoundTripper
+	timeout time.Duration
+}
+
+func (t *idleTimeout) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancelCause(req.Context())
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel(nil)
+		return nil, err
+	}
+	stalled := fmt.Errorf("%w: no data for %s", ErrIdleTimeout, t.timeout)
+	timer := time.AfterFunc(t.timeout, func() { cancel(stalled) })
+	timer.Stop()
+	resp.Body = &idleBody{ReadCloser: resp.Body, ctx: ctx, cancel: cancel, timer: timer, timeout: t.timeout}
+	return resp, nil
+}
+
+type idleBody struct {
+	io.ReadCloser
+	ctx     context.Context
+	cancel  context.CancelCauseFunc
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func (b *idleBody) Read(p []byte) (int, error) {
+	b.timer.Reset(b.timeout)
+	n, err := b.ReadCloser.Read(p)
+	b.timer.Stop()
+	if err != nil && errors.Is(context.Cause(b.ctx), ErrIdleTimeout) {
+		err = context.Cause(b.ctx)
+	}
+	return n, err
+}
+
+func (b *idleBody) Close() error {
+	b.timer.Stop()
+	b.cancel(nil)
+	return b.ReadCloser.Close()
+}
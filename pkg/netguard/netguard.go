@@ -0,0 +1,311 @@
+// Package netguard keeps outbound requests away from internal networks. A
+// Guard checks every address a request is about to connect to, after DNS
+// resolution and after each redirect, so that a host name pointing to a
+// private address or a redirect to one is caught as well.
+package netguard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var ErrBlocked = errors.New("address is blocked")
+
+// maxRedirects is how many redirects a guarded client follows, as many as
+// the default one.
+const maxRedirects = 10
+
+// blockedRanges are the networks a request may not reach unless they are
+// allowed explicitly.
+var blockedRanges = []struct {
+	prefix netip.Prefix
+	name   string
+}{
+	{netip.MustParsePrefix("0.0.0.0/8"), "unspecified"},
+	{netip.MustParsePrefix("10.0.0.0/8"), "private"},
+	{netip.MustParsePrefix("100.64.0.0/10"), "shared"},
+	{netip.MustParsePrefix("127.0.0.0/8"), "loopback"},
+	{netip.MustParsePrefix("169.254.0.0/16"), "link-local"},
+	{netip.MustParsePrefix("172.16.0.0/12"), "private"},
+	{netip.MustParsePrefix("192.0.0.0/24"), "reserved"},
+	{netip.MustParsePrefix("192.168.0.0/16"), "private"},
+	{netip.MustParsePrefix("198.18.0.0/15"), "benchmarking"},
+	{netip.MustParsePrefix("224.0.0.0/4"), "multicast"},
+	{netip.MustParsePrefix("240.0.0.0/4"), "reserved"},
+	{netip.MustParsePrefix("::/128"), "unspecified"},
+	{netip.MustParsePrefix("::1/128"), "loopback"},
+	{netip.MustParsePrefix("64:ff9b:1::/48"), "local NAT64"},
+	{netip.MustParsePrefix("fc00::/7"), "private"},
+	{netip.MustParsePrefix("fe80::/10"), "link-local"},
+	{netip.MustParsePrefix("ff00::/8"), "multicast"},
+}
+
+// nat64 and sixToFour are the ranges of IPv6 addresses that reach the IPv4
+// address they embed.
+var (
+	nat64     = netip.MustParsePrefix("64:ff9b::/96")
+	sixToFour = netip.MustParsePrefix("2002::/16")
+)
+
+// embeddedIPv4 returns the IPv4 address a NAT64 or 6to4 address leads to.
+func embeddedIPv4(addr netip.Addr) (netip.Addr, bool) {
+	b := addr.As16()
+	switch {
+	case nat64.Contains(addr):
+		return netip.AddrFrom4([4]byte(b[12:16])), true
+	case sixToFour.Contains(addr):
+		return netip.AddrFrom4([4]byte(b[2:6])), true
+	}
+	return netip.Addr{}, false
+}
+
+// Config lists the exceptions to the blocked ranges. Entries are CIDRs, IP
+// addresses or host names; "*.example.com" matches the subdomains of
+// example.com.
+type Config struct {
+	// Allow lets requests reach the networks and hosts in spite of the
+	// blocked ranges.
+	Allow []string
+	// Deny blocks the networks and hosts as well, even if they are allowed.
+	Deny []string
+	// Logf, if set, is called for every blocked attempt.
+	Logf func(template string, args ...interface{})
+}
+
+type rules struct {
+	nets  []netip.Prefix
+	hosts []string
+}
+
+func parseRules(entries []string) (rules, error) {
+	var r rules
+	for _, entry := range entries {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		switch {
+		case entry == "":
+		case strings.Contains(entry, "/"):
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return rules{}, err
+			}
+			r.nets = append(r.nets, prefix.Masked())
+		default:
+			if addr, err := netip.ParseAddr(entry); err == nil {
+				r.nets = append(r.nets, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			} else {
+				r.hosts = append(r.hosts, entry)
+			}
+		}
+	}
+	return r, nil
+}
+
+func (r rules) matchHost(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, h := range r.hosts {
+		if suffix, ok := strings.CutPrefix(h, "*"); ok {
+			if strings.HasSuffix(host, suffix) {
+				return true
+			}
+		} else if host == h {
+			return true
+		}
+	}
+	return false
+}
+
+func (r rules) matchAddr(addr netip.Addr) bool {
+	for _, prefix := range r.nets {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Guard decides which addresses outbound requests may connect to.
+type Guard struct {
+	allow rules
+	deny  rules
+	logf  func(template string, args ...interface{})
+}
+
+func New(cfg Config) (*Guard, error) {
+	allow, err := parseRules(cfg.Allow)
+	if err != nil {
+		return nil, fmt.Errorf("bad allow entry: %w", err)
+	}
+	deny, err := parseRules(cfg.Deny)
+	if err != nil {
+		return nil, fmt.Errorf("bad deny entry: %w", err)
+	}
+	return &Guard{allow: allow, deny: deny, logf: cfg.Logf}, nil
+}
+
+// CheckURL returns ErrBlocked if the host of the URL is denied or is an
+// address in a blocked range. Host names are not resolved here; their
+// addresses are checked when they are dialed.
+func (g *Guard) CheckURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	host := u.Hostname()
+	if err := g.checkHost(host); err != nil {
+		return err
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return g.checkAddr(host, addr)
+	}
+	return nil
+}
+
+func (g *Guard) checkHost(host string) error {
+	if g.deny.matchHost(host) {
+		return g.blocked(host, "host is denied")
+	}
+	return nil
+}
+
+// checkAddr checks an address host resolved to.
+func (g *Guard) checkAddr(host string, addr netip.Addr) error {
+	addr = addr.Unmap().WithZone("")
+	if g.deny.matchAddr(addr) {
+		return g.blocked(host, fmt.Sprintf("%s is denied", addr))
+	}
+	if g.allow.matchHost(host) || g.allow.matchAddr(addr) {
+		return nil
+	}
+	if v4, ok := embeddedIPv4(addr); ok {
+		if err := g.checkAddr(host, v4); err != nil {
+			return err
+		}
+	}
+	for _, r := range blockedRanges {
+		if r.prefix.Contains(addr) {
+			return g.blocked(host, fmt.Sprintf("%s is %s", addr, r.name))
+		}
+	}
+	return nil
+}
+
+func (g *Guard) blocked(host, reason string) error {
+	if g.logf != nil {
+		g.logf("blocked outbound request to %s: %s", host, reason)
+	}
+	return fmt.Errorf("%w: %s: %s", ErrBlocked, host, reason)
+}
+
+// DialContext returns a dial function that connects through d only to the
+// addresses the guard allows. The address is checked after the host name is
+// resolved, right before the connection is made.
+func (g *Guard) DialContext(d *net.Dialer) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		if err := g.checkHost(host); err != nil {
+			return nil, err
+		}
+		dialer := *d
+		control := d.Control
+		dialer.Control = func(network, address string, c syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			if err := g.checkAddr(host, addrPort.Addr()); err != nil {
+				return err
+			}
+			if control != nil {
+				return control(network, address, c)
+			}
+			return nil
+		}
+		return dialer.DialContext(ctx, network, address)
+	}
+}
+
+// CheckRedirect is an http.Client CheckRedirect that refuses redirects to
+// blocked hosts.
+func (g *Guard) CheckRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxRedirects)
+	}
+	return g.CheckURL(req.URL.String())
+}
+
+// checkResolved resolves host and checks all its addresses. It guards
+// requests sent through a proxy, which resolves the host itself.
+func (g *Guard) checkResolved(ctx context.Context, host string) error {
+	if err := g.checkHost(host); err != nil {
+		return err
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return g.checkAddr(host, addr)
+	}
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if err := g.checkAddr(host, addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Protect makes t dial through d and the guard. Proxies of t are trusted:
+// the guard lets t connect to them wherever they are and checks the target
+// of each proxied request by resolving its host instead.
+func (g *Guard) Protect(t *http.Transport, d *net.Dialer) {
+	var proxies sync.Map
+	if proxy := t.Proxy; proxy != nil {
+		t.Proxy = func(req *http.Request) (*url.URL, error) {
+			u, err := proxy(req)
+			if err != nil || u == nil {
+				return u, err
+			}
+			if err := g.checkResolved(req.Context(), req.URL.Hostname()); err != nil {
+				return nil, err
+			}
+			proxies.Store(proxyAddr(u), struct{}{})
+			return u, nil
+		}
+	}
+	dial := g.DialContext(d)
+	t.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		if _, ok := proxies.Load(address); ok {
+			return d.DialContext(ctx, network, address)
+		}
+		return dial(ctx, network, address)
+	}
+}
+
+// proxyAddr returns the address the transport dials for the proxy.
+func proxyAddr(u *url.URL) string {
+	if port := u.Port(); port != "" {
+		return net.JoinHostPort(u.Hostname(), port)
+	}
+	port := map[string]string{"http": "80", "https": "443", "socks5": "1080", "socks5h": "1080"}[u.Scheme]
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// Client returns a client whose connections and redirects are checked by
+// the guard.
+func (g *Guard) Client() *http.Client {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	g.Protect(t, &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second})
+	return &http.Client{Transport: t, CheckRedirect: g.CheckRedirect}
+}
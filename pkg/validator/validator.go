@@ -1,6 +1,11 @@
 package validator
 
-import "net/url"
+import (
+	"errors"
+	"net/url"
+)
+
+var ErrNotValidURL = errors.New("not valid url")
 
 func IsValidURL(checkableURL string) bool {
 	u, err := url.Parse(checkableURL)
@@ -8,7 +13,7 @@ func IsValidURL(checkableURL string) bool {
 		return false
 	}
 
-	if u.Scheme != "http" && u.Scheme != "https" && u.Host == "" {
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
 		return false
 	}
 